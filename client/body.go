@@ -0,0 +1,119 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements client-side streaming of request bodies.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	p "github.com/firepear/petrel"
+)
+
+// defaultChunkSize is the default Config.ChunkSize
+const defaultChunkSize = 64 * 1024
+
+// DispatchBody sends a request whose handler on the server is a
+// BodyHandler. The request body is read from body and sent in chunks
+// of Config.ChunkSize bytes, so it may be any size, and is never held
+// in memory all at once. Meanwhile, the response is streamed to w as
+// it arrives.
+//
+// When the response is complete, DispatchBody returns its final Resp,
+// which holds its status. If the response was not streamed (as when
+// the request is refused), any payload it carries is left in the Resp
+// rather than being written to w. An Error level status is returned
+// as a *StatusError; any other status is left for the caller to check
+// in the Resp.
+//
+// If the server finishes its response before the whole body has been
+// sent, DispatchBody stops reading body. If ctx is done before the
+// response is complete, the request is abandoned, and ctx's error is
+// returned; the connection is left open.
+func (c *Client) DispatchBody(ctx context.Context, req string, body io.Reader, w io.Writer) (*p.Resp, error) {
+	size := c.cfg.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	buf := make([]byte, size)
+	n, rerr := io.ReadFull(body, buf)
+	if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("couldn't read request body: %w", rerr)
+	}
+	call := &Call{Req: req, Done: make(chan struct{}), flags: p.FlagStream,
+		ch: make(chan *p.Resp, 16), stop: make(chan struct{})}
+	if rerr != nil {
+		// the whole body fits in the first chunk
+		call.flags = p.FlagEOS
+	}
+	if err := c.start(ctx, call, buf[:n]); err != nil {
+		return nil, err
+	}
+
+	// the response is copied out while the body is sent, so that
+	// a handler which writes as it reads is never left waiting
+	s := &Stream{call: call}
+	var cerr error
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		if _, cerr = io.Copy(w, s); cerr != nil {
+			// w failed. drop the rest of the response
+			_ = s.Close()
+		}
+	}()
+
+	var serr error
+	for rerr == nil {
+		n, rerr = io.ReadFull(body, buf)
+		flags := p.FlagStream
+		switch {
+		case rerr == io.EOF || rerr == io.ErrUnexpectedEOF:
+			flags = p.FlagEOS
+			rerr = io.EOF
+		case rerr != nil:
+			// end the body, so that the server stops
+			// waiting for it. the handler sees a short body
+			serr = fmt.Errorf("couldn't read request body: %w", rerr)
+			flags, n = p.FlagEOS, 0
+		}
+		select {
+		case <-copied:
+			// the response is complete (or w has failed),
+			// so the rest of the body is not wanted. the
+			// server still needs to see its end
+			flags, n, rerr = p.FlagEOS, 0, io.EOF
+		case <-ctx.Done():
+			flags, n, rerr = p.FlagEOS, 0, io.EOF
+		default:
+		}
+		err := p.ConnSend(call.conn, &p.Resp{Seq: call.Seq, Req: req,
+			Flags: flags, Payload: buf[:n]})
+		if err != nil {
+			c.closeConn(call.conn, p.WriteStatus(err), err)
+			break
+		}
+	}
+
+	select {
+	case <-copied:
+	case <-ctx.Done():
+		c.abandon(call, 494, ctx.Err())
+		_ = s.Close()
+		<-copied
+	}
+	var se *StatusError
+	if errors.As(cerr, &se) && (se.Status > 1024 || p.Stats[se.Status].Lvl != "Error") {
+		// the status is in the Resp
+		cerr = nil
+	}
+	if cerr == nil {
+		cerr = serr
+	}
+	return s.Resp(), cerr
+}
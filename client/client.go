@@ -7,33 +7,156 @@ package client // import "github.com/firepear/petrel/client"
 // This file implements the Petrel client.
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"sync"
 	"time"
 
 	p "github.com/firepear/petrel"
 )
 
 // Client is a Petrel client instance.
+//
+// A Client may be used from multiple goroutines, with one exception:
+// Dispatch is synchronous and stores its result in Client.Resp, which
+// is shared, so it is only suitable for one-at-a-time use. Concurrent
+// callers should use RoundTrip, DispatchTyped, or DispatchAsync,
+// which return their own responses.
 type Client struct {
+	// Resp holds the response to the last request made with
+	// Dispatch or DispatchCtx. Concurrent Dispatches do not
+	// corrupt it, but which of their responses it holds is
+	// anyone's guess, and reading it while a Dispatch is underway
+	// is a data race.
 	Resp *p.Resp
+	// Push receives messages which the server sends on its own
+	// initiative, rather than in reply to a request. Resp.Req
+	// holds the name the server gave the message. If Push is
+	// full when a message arrives, the message is dropped. Push
+	// is closed when the Client is finished: when Quit is
+	// called, or when its connection closes and it is not
+	// configured to reconnect.
+	Push chan *p.Resp
+	// client configuration
+	cfg *Config
+	// request timeout
+	t time.Duration
+	// quit signal channel; closed by Quit
+	q chan struct{}
+	// rc serializes reconnects. it is a semaphore rather than a
+	// mutex, so that waiting for it can be given up on
+	rc chan struct{}
+	// rmu guards writes to Resp
+	rmu sync.Mutex
+	// mu guards everything below it
+	mu sync.Mutex
+	// the current connection
 	conn *p.Conn
 	// conn closed semaphore
 	cc bool
+	// Quit has been called
+	quit bool
+	// the handshake is in progress on the current conn
+	hs bool
+	// Push has been closed
+	pc bool
+	// the server has said it is going away
+	ga bool
+	// status which caused the conn to be closed
+	cs uint16
+	// request sequence counter
+	seq uint32
+	// requests awaiting a response, keyed by sequence number
+	pend map[uint32]*Call
+	// span reporting
+	tr p.Tracer
+	// payload encoding for DispatchTyped
+	cdc p.Codec
+}
+
+// Call is a request which has been sent by DispatchAsync. Done is
+// closed when its response has arrived (or the request has failed),
+// at which point Resp and Err are populated.
+type Call struct {
+	Req  string
+	Seq  uint32
+	Resp *p.Resp
+	Err  error
+	Done chan struct{}
+	// stream chunk channel; nil unless the Call belongs to a
+	// Stream
+	ch chan *p.Resp
+	// closed when a Stream is abandoned by its reader
+	stop chan struct{}
+	// accumulated stream chunks, for non-Stream Calls which get a
+	// streamed response
+	buf []byte
+	// the connection the Call was sent on
+	conn *p.Conn
+	// trace context sent with the request, and the span
+	// reporting it; both are zero if it is not traced
+	trace p.Trace
+	span  *p.Span
+	// stream bytes received
+	nin int
+	// header flags for the request's first transmission
+	flags uint8
+}
+
+// Wait blocks until the Call is complete, then returns its response
+// and error.
+func (cl *Call) Wait() (*p.Resp, error) {
+	<-cl.Done
+	return cl.Resp, cl.Err
 }
 
 // Config holds values to be passed to the client constructor.
 type Config struct {
 	// Address is either an IPv4 or IPv6 address followed by the
-	// desired port number ("127.0.0.1:9090", "[::1]:9090").
+	// desired port number ("127.0.0.1:9090", "[::1]:9090"). For
+	// unix domain sockets, it is the path of the socket file, or
+	// a name beginning with '@' for a Linux abstract socket.
 	Addr string
 
+	// Network is the type of socket to connect to: "tcp" or
+	// "unix". Default (empty) is "tcp".
+	Network string
+
 	// Timeout is the number of milliseconds the client will wait
 	// before timing out due to on a Dispatch() or Read()
-	// call. Default is no timeout (zero).
+	// call. Default is no timeout (zero). A request which times
+	// out fails with status 494, and closes the connection.
+	//
+	// Timeout is also the default for each of the network
+	// timeouts below which is zero.
 	Timeout int64
 
+	// HeaderTimeout is the number of milliseconds allowed to read
+	// a response's header and name, once it has begun to arrive
+	// (status 491). The client has no idle timeout, as it is
+	// always waiting for the server to send something.
+	HeaderTimeout int64
+
+	// PayloadTimeout is the number of milliseconds allowed to
+	// read a response's payload, once its header has been read
+	// (status 492).
+	PayloadTimeout int64
+
+	// MinRate is the slowest rate, in bytes per second, at which
+	// a payload may arrive. It lengthens PayloadTimeout in
+	// proportion to the size of the payload. Default (0) is no
+	// minimum.
+	MinRate uint32
+
+	// WriteTimeout is the number of milliseconds allowed to send
+	// a request (status 493).
+	WriteTimeout int64
+
 	// TLS is the (optional) TLS configuration. If it is nil, the
 	// connection will be unencrypted.
 	TLS *tls.Config
@@ -42,8 +165,11 @@ type Config struct {
 	// from the network (functionally it limits request or
 	// response payload size). If a read exceeds this limit,
 	// the connection will be dropped. Use this to prevent memory
-	// exhaustion by arbitrarily long network reads. The default
-	// (0) is unlimited.
+	// exhaustion by arbitrarily long network reads. It also
+	// limits the total size of a streamed response to a request
+	// made with Dispatch rather than DispatchStream, as its chunks
+	// are gathered into one payload; one which goes over gets
+	// status 402. The default (0) is unlimited.
 	Xferlim uint32
 
 	//HMACKey is the secret key used to generate MACs for signing
@@ -51,84 +177,663 @@ type Config struct {
 	//generated for messages sent, or expected for messages
 	//received.
 	HMACKey []byte
+
+	// PushBuffer sets how many server push messages may be queued
+	// in Client.Push. Defaults to 16.
+	PushBuffer int
+
+	// Credentials are sent to the server during the PROTOCHECK
+	// handshake, for servers which require authentication. Default
+	// (nil) sends no credentials.
+	Credentials *p.Credentials
+
+	// Reconnect, if set, makes the Client reconnect when its
+	// connection is lost or closed by an Error level status,
+	// following the given RetryPolicy. A request which finds the
+	// connection closed waits for it to be reopened, but no longer
+	// than Timeout or its context allows. A lost connection is
+	// redialed in the background, and only Quit stops that, so a
+	// reconnecting Client must always be shut down with Quit.
+	// Default (nil) is for the Client to stay closed, as a new
+	// Client must be created.
+	Reconnect *RetryPolicy
+
+	// Idempotent lists requests which are safe to send more
+	// than once. If a reconnecting Client's connection is lost
+	// while one of these requests is awaiting a response, it is
+	// resent on the new connection by Dispatch.
+	Idempotent []string
+
+	// Keepalive is the number of milliseconds between keepalive
+	// PINGs. Keepalives find dead connections which would
+	// otherwise go unnoticed until the next request, and keep the
+	// server's IdleTimeout from closing the connection. Default
+	// (0) is no keepalives.
+	Keepalive int64
+
+	// KeepaliveMisses is how many keepalives in a row may go
+	// unanswered before the connection is closed (status
+	// 489). Each is given Keepalive milliseconds to be
+	// answered. Default (0) is 3.
+	KeepaliveMisses int
+
+	// Compress lists the Compressors (by name) the Client can
+	// use, in order of preference. The server picks one during
+	// the PROTOCHECK handshake, if it has any in common. Default
+	// (nil) is no compression.
+	Compress []string
+
+	// CompressMin is the size, in bytes, below which request
+	// payloads are sent uncompressed. Default (0) is
+	// petrel.DefaultCompressMin. Xferlim applies to payloads
+	// both as sent and once decompressed.
+	CompressMin int
+
+	// ChunkSize is the size, in bytes, of the chunks a request
+	// body is sent in by DispatchBody. It must not be more than
+	// the server's Xferlim. Default (0) is 64KiB.
+	ChunkSize int
+
+	// Codec encodes and decodes the payloads of requests made
+	// with DispatchTyped. It must match the server's. Default (nil) is
+	// petrel.JSONCodec.
+	Codec p.Codec
+
+	// Tracer, if set, receives a span for every request the
+	// Client sends. Requests made with a context which carries a
+	// Trace (such as the context a server passes to a
+	// HandlerCtx) are traced whether or not a Tracer is set, so
+	// that the trace continues on to the server. Default (nil) is
+	// petrel.NopTracer.
+	Tracer p.Tracer
+
+	// OnState, if set, is called whenever the Client's
+	// connection state changes. It is called synchronously, and
+	// should return quickly.
+	OnState func(State)
 }
 
 // New returns a new Client, configured and ready to use.
 func New(c *Config) (*Client, error) {
-	var conn net.Conn
+	// set c.PushBuffer to the default if it's zero
+	if c.PushBuffer == 0 {
+		c.PushBuffer = 16
+	}
+
+	client := &Client{
+		Resp: &p.Resp{},
+		Push: make(chan *p.Resp, c.PushBuffer),
+		cfg:  c,
+		t:    time.Duration(c.Timeout) * time.Millisecond,
+		q:    make(chan struct{}),
+		rc:   make(chan struct{}, 1),
+		cc:   true,
+		pend: make(map[uint32]*Call),
+		tr:   c.Tracer,
+		cdc:  c.Codec,
+	}
+	if client.tr == nil {
+		client.tr = p.NopTracer{}
+	}
+	if client.cdc == nil {
+		client.cdc = p.JSONCodec
+	}
+	err := client.connect(context.Background())
+	if err != nil {
+		_ = client.Quit()
+		return nil, err
+	}
+	client.state(StateConnected)
+	if c.Keepalive > 0 {
+		go client.keepalive()
+	}
+	return client, nil
+}
+
+// connect dials the server and performs the PROTOCHECK handshake,
+// making the resulting connection the Client's current one. If ctx is
+// done first, connect gives up.
+func (c *Client) connect(ctx context.Context) error {
+	var nc net.Conn
 	var err error
 
-	if c.TLS == nil {
-		conn, err = net.Dial("tcp", c.Addr)
+	network := c.cfg.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if c.cfg.TLS == nil {
+		nc, err = (&net.Dialer{}).DialContext(ctx, network, c.cfg.Addr)
 	} else {
-		conn, err = tls.Dial("tcp", c.Addr, c.TLS)
+		nc, err = (&tls.Dialer{Config: c.cfg.TLS}).DialContext(ctx, network, c.cfg.Addr)
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	pconn := &p.Conn{
-		NC:      conn,
-		Plim:    c.Xferlim,
-		Hkey:    c.HMACKey,
-		Timeout: time.Duration(c.Timeout) * time.Millisecond,
+	// the client conn has no idle timeout. reads happen in the
+	// background for the life of the conn, so an idle deadline
+	// would kill idle clients; request timeouts are handled in
+	// Dispatch instead.
+	conn := &p.Conn{
+		NC:             nc,
+		Plim:           c.cfg.Xferlim,
+		Hkey:           c.cfg.HMACKey,
+		HeaderTimeout:  c.timeout(c.cfg.HeaderTimeout),
+		PayloadTimeout: c.timeout(c.cfg.PayloadTimeout),
+		WriteTimeout:   c.timeout(c.cfg.WriteTimeout),
+		MinRate:        c.cfg.MinRate,
 	}
-	client := &Client{&pconn.Resp, pconn, false}
 
-	err = client.Dispatch("PROTOCHECK", p.Proto)
+	c.mu.Lock()
+	if c.quit {
+		c.mu.Unlock()
+		_ = nc.Close()
+		return fmt.Errorf("client has quit")
+	}
+	c.conn = conn
+	c.hs = true
+	c.ga = false
+	c.mu.Unlock()
+	go c.connReader(conn)
+
+	// the handshake payload is our protocol version, followed by
+	// our credentials and compressors if we have any
+	hello := append([]byte{}, p.Proto...)
+	if c.cfg.Credentials != nil || len(c.cfg.Compress) > 0 {
+		h := p.Hello{Compress: c.cfg.Compress}
+		if c.cfg.Credentials != nil {
+			h.Credentials = *c.cfg.Credentials
+		}
+		body, err := json.Marshal(h)
+		if err != nil {
+			c.closeConn(conn, 501, err)
+			return err
+		}
+		hello = append(hello, body...)
+	}
+
+	// the handshake's response is kept out of c.Resp, as a
+	// reconnect may be happening while other goroutines Dispatch
+	call := &Call{Req: "PROTOCHECK", Done: make(chan struct{})}
+	resp := &p.Resp{Status: 499}
+	err = c.send(ctx, call, hello)
+	if err == nil {
+		resp, err = c.waitCtx(ctx, call)
+	}
 	if err != nil {
-		_ = client.Quit()
-		return nil, err
+		c.closeConn(conn, resp.Status, err)
+		return err
 	}
-	if client.Resp.Status > 200 {
-		_ = client.Quit()
-		if client.Resp.Status == 400 {
-			return nil, fmt.Errorf("[400] PROTOCHECK unsupported")
+	if resp.Status > 200 {
+		c.closeConn(conn, resp.Status, nil)
+		if resp.Status == 400 {
+			return fmt.Errorf("[400] PROTOCHECK unsupported")
+		}
+		if resp.Status == 495 {
+			return fmt.Errorf("[495] %s: %s", p.Stats[495].Txt,
+				resp.Payload)
 		}
-		if client.Resp.Status == 497 {
-			return nil, fmt.Errorf("[497] %s client v%d; server v%d",
+		if resp.Status == 496 {
+			return fmt.Errorf("[496] %s", p.Stats[496].Txt)
+		}
+		if resp.Status == 497 {
+			return fmt.Errorf("[497] %s client v%d; server v%d",
 				p.Stats[497].Txt,
-				p.Proto[0], client.Resp.Payload[0])
+				p.Proto[0], resp.Payload[0])
 		}
-		return nil, fmt.Errorf("status %d %s", client.Resp.Status,
-			p.Stats[client.Resp.Status].Txt)
+		return fmt.Errorf("status %d %s", resp.Status,
+			p.Stats[resp.Status].Txt)
 	}
-	return client, nil
+
+	// the conn is open for business
+	c.mu.Lock()
+	c.hs = false
+	c.cc = false
+	c.mu.Unlock()
+	return nil
+}
+
+// timeout converts a Config timeout to a Duration, defaulting to
+// Config.Timeout
+func (c *Client) timeout(ms int64) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return c.t
 }
 
 // Dispatch sends a request and places the response in Client.Resp. If
 // Resp.Status has a level of Error or Fatal, the Client will close
 // its network connection
+//
+// If the server refuses the request because of a rate limit, the
+// error is a *RateLimitError, which says how long to wait before
+// trying again.
+//
+// If the Client is configured to reconnect, a closed connection is
+// reopened before the request is sent, and a request listed in
+// Config.Idempotent which loses its connection before getting a
+// response is resent.
 func (c *Client) Dispatch(req string, payload []byte) error {
-	// if a previous error closed the conn, refuse to do anything
-	if c.cc {
-		return fmt.Errorf("%d network conn closed; please create a new Client",
-			c.Resp.Status)
+	return c.DispatchCtx(context.Background(), req, payload)
+}
+
+// DispatchCtx is Dispatch with a context. If ctx is done before the
+// response arrives, DispatchCtx gives up on the request and returns
+// ctx's error; the connection is left open, and a late response is
+// discarded. A Client which is waiting to reconnect also gives up
+// when ctx is done, or when its Timeout has passed. If ctx carries a
+// Trace, the request is sent as part of that trace.
+func (c *Client) DispatchCtx(ctx context.Context, req string, payload []byte) error {
+	resp, err := c.roundTrip(ctx, req, payload)
+	if resp != nil {
+		c.rmu.Lock()
+		*c.Resp = *resp
+		c.rmu.Unlock()
+	}
+	return err
+}
+
+// RoundTrip is DispatchCtx, except that it returns the response
+// rather than placing it in Client.Resp, so it is safe to use from
+// many goroutines at once.
+func (c *Client) RoundTrip(ctx context.Context, req string, payload []byte) (*p.Resp, error) {
+	return c.roundTrip(ctx, req, payload)
+}
+
+// roundTrip sends a request and waits for its response, resending it
+// if it is idempotent and its connection is lost. Unlike DispatchCtx,
+// it does not touch c.Resp.
+func (c *Client) roundTrip(ctx context.Context, req string, payload []byte) (*p.Resp, error) {
+	resends := 0
+	for {
+		resp, err := c.dispatch(ctx, req, payload)
+		var rl *RateLimitError
+		if err == nil || errors.As(err, &rl) || ctx.Err() != nil ||
+			!c.resendable(req, resends) {
+			return resp, err
+		}
+		resends++
+	}
+}
+
+// dispatch does the work of a single Dispatch attempt
+func (c *Client) dispatch(ctx context.Context, req string, payload []byte) (*p.Resp, error) {
+	call, err := c.DispatchAsyncCtx(ctx, req, payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.waitCtx(ctx, call)
+}
+
+// wait waits for a Call to complete, subject to the Client's
+// timeout
+func (c *Client) wait(call *Call) (*p.Resp, error) {
+	return c.waitCtx(context.Background(), call)
+}
+
+// waitCtx waits for a Call to complete, subject to the Client's
+// timeout and to ctx
+func (c *Client) waitCtx(ctx context.Context, call *Call) (*p.Resp, error) {
+	var timeout <-chan time.Time
+	if c.t > 0 {
+		timer := time.NewTimer(c.t)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if c.t > 0 || ctx.Done() != nil {
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			c.abandon(call, 494, ctx.Err())
+			<-call.Done
+		case <-timeout:
+			// the server may be wedged, so the
+			// connection is done
+			c.closeConn(call.conn, 494, fmt.Errorf("%s: no response after %s",
+				p.Stats[494].Txt, c.t))
+			<-call.Done
+		}
+	}
+	return call.Wait()
+}
+
+// DispatchAsync sends a request and returns immediately. The returned
+// Call completes when the matching response arrives. Any number of
+// calls may be outstanding at once, from any number of goroutines;
+// responses are matched to requests by sequence number, and may
+// arrive in any order.
+//
+// As with Dispatch, a response with an Error level status causes the
+// Client to close its network connection, failing any other
+// outstanding Calls.
+func (c *Client) DispatchAsync(req string, payload []byte) (*Call, error) {
+	return c.DispatchAsyncCtx(context.Background(), req, payload)
+}
+
+// DispatchAsyncCtx is DispatchAsync with a context. If ctx carries a
+// Trace, the request is sent as part of that trace. A Client which
+// has to reconnect before sending gives up when ctx is done, or when
+// its Timeout has passed. Once the request is sent, ctx no longer
+// matters; it does not limit the wait for the response.
+func (c *Client) DispatchAsyncCtx(ctx context.Context, req string, payload []byte) (*Call, error) {
+	call := &Call{Req: req, Done: make(chan struct{})}
+	return call, c.start(ctx, call, payload)
+}
+
+// abandon fails a Call which its caller has stopped waiting for, or
+// whose response cannot be taken, with status and err. If its
+// response is already being delivered, that wins.
+func (c *Client) abandon(call *Call, status uint16, err error) {
+	c.mu.Lock()
+	mine := c.pend[call.Seq] == call
+	if mine {
+		delete(c.pend, call.Seq)
 	}
+	c.mu.Unlock()
+	if mine {
+		call.Resp = &p.Resp{Status: status, Seq: call.Seq, Req: call.Req}
+		call.Err = err
+		c.complete(call)
+	}
+}
+
+// send registers call as pending, then transmits it. On success,
+// call.Seq has been set. If the connection has to be reopened first,
+// that is given up on when ctx is done or the Client's timeout
+// passes.
+func (c *Client) send(ctx context.Context, call *Call, payload []byte) error {
+	req := call.Req
 	// check for cmd length
 	if len(req) > 255 {
 		return fmt.Errorf("invalid request: '%s' > 255 bytes", req)
 	}
-	// increment sequence
-	c.conn.Seq++
+	// reopen the conn if it has closed and we are configured to
+	// do so. the handshake itself is exempt, as it is what opens
+	// the conn
+	handshake := req == "PROTOCHECK"
+	if !handshake && c.Closed() && c.cfg.Reconnect != nil {
+		if c.t > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.t)
+			defer cancel()
+		}
+		if err := c.reconnect(ctx); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	// if a previous error closed the conn, refuse to do anything
+	if c.cc && !(handshake && c.hs) {
+		c.mu.Unlock()
+		if c.cfg.Reconnect != nil {
+			return fmt.Errorf("%d network conn closed", c.cs)
+		}
+		return fmt.Errorf("%d network conn closed; please create a new Client",
+			c.cs)
+	}
+	// increment sequence and register the call
+	c.seq++
+	call.Seq = c.seq
+	call.conn = c.conn
+	c.pend[call.Seq] = call
+	c.mu.Unlock()
+
 	// send data
-	err := p.ConnWrite(c.conn, []byte(req), payload)
+	err := p.ConnSend(call.conn, &p.Resp{Seq: call.Seq, Req: req,
+		Flags: call.flags, Payload: payload, Trace: call.trace})
 	if err != nil {
+		c.mu.Lock()
+		delete(c.pend, call.Seq)
+		c.mu.Unlock()
 		return fmt.Errorf("failed to send request '%s'", err)
 	}
-	// read response
-	err = p.ConnRead(c.conn)
-	// if our response status is Error, close the connection and
-	// flag ourselves as done
-	if c.Resp.Status <= 1024 && p.Stats[c.Resp.Status].Lvl == "Error" {
-		_ = c.Quit()
-	}
-	return err
+	return nil
+}
+
+// Closed reports whether the Client's network connection has been
+// closed, either by Quit or because of an error.
+func (c *Client) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cc
 }
 
 // Quit terminates the client's network connection and other
-// operations.
+// operations, including any reconnection underway. It must be called
+// when a Client is no longer needed.
 func (c *Client) Quit() error {
+	c.mu.Lock()
+	first := !c.quit
+	if first {
+		c.quit = true
+		close(c.q)
+	}
+	if !c.cc {
+		c.cc = true
+		c.cs = 198
+	}
+	conn := c.conn
+	c.mu.Unlock()
+	c.closePush()
+	var err error
+	if conn != nil {
+		err = conn.NC.Close()
+	}
+	if first {
+		c.state(StateClosed)
+	}
+	return err
+}
+
+// connReader runs for the life of a connection, reading responses
+// from the network and handing each one to the Call which is waiting
+// on it.
+func (c *Client) connReader(conn *p.Conn) {
+	for {
+		err := p.ConnRead(conn)
+		if err != nil {
+			c.closeConn(conn, conn.Resp.Status, err)
+			return
+		}
+		resp := conn.Resp
+		if resp.Flags&p.FlagPush != 0 {
+			if resp.Status == 197 || resp.Status == 490 {
+				c.goaway(conn, resp.Status)
+			}
+			c.push(&resp)
+			continue
+		}
+		if resp.Req == "PROTOCHECK" && resp.Status == 200 {
+			// the server may compress anything it sends
+			// after this, so the compressor it chose
+			// goes into use before the next read
+			c.compression(conn, resp.Payload)
+		}
+		c.mu.Lock()
+		call, ok := c.pend[resp.Seq]
+		if resp.Flags&p.FlagStream == 0 {
+			delete(c.pend, resp.Seq)
+		}
+		c.mu.Unlock()
+		if resp.Flags&p.FlagStream != 0 {
+			if ok && !call.chunk(&resp, conn.Plim) {
+				// the rest of the stream is dropped, as
+				// its Seq is no longer pending
+				c.abandon(call, 402, fmt.Errorf("%s: streamed response > %d bytes",
+					p.Stats[402].Txt, conn.Plim))
+			}
+			continue
+		}
+		if ok && call.buf != nil {
+			// a streamed response to a plain Call gets
+			// its chunks as its payload
+			resp.Payload = call.buf
+		}
+		// if our response status is Error, close the
+		// connection and flag ourselves as done. this happens
+		// before the Call is completed, so that its caller
+		// never sees a usable Client after a fatal status
+		fatal := resp.Status <= 1024 && p.Stats[resp.Status].Lvl == "Error"
+		if fatal {
+			c.closeConn(conn, resp.Status, nil)
+		}
+		if ok {
+			call.Resp = &resp
+			if resp.Status == 429 {
+				call.Err = rateLimited(&resp)
+			}
+			c.complete(call)
+		}
+		if fatal {
+			return
+		}
+	}
+}
+
+// closeConn shuts down a network connection, and fails all Calls
+// which are outstanding on it with status and err. If conn is the
+// Client's current connection, the Client is marked as closed.
+func (c *Client) closeConn(conn *p.Conn, status uint16, err error) {
+	c.mu.Lock()
+	current := conn == c.conn
+	// lost is true if this is news: the current conn was open (or
+	// opening, or going away) and we did not Quit
+	lost := current && !c.quit && (!c.cc || c.hs || c.ga)
+	handshake := current && c.hs
+	if current {
+		if !c.cc {
+			c.cc = true
+			c.cs = status
+		}
+		c.hs = false
+		c.ga = false
+	}
+	pend := []*Call{}
+	for seq, call := range c.pend {
+		if call.conn == conn {
+			pend = append(pend, call)
+			delete(c.pend, seq)
+		}
+	}
+	c.mu.Unlock()
+	_ = conn.NC.Close()
+
+	if err == nil {
+		err = fmt.Errorf("%d network conn closed", status)
+	}
+	for _, call := range pend {
+		call.Resp = &p.Resp{Status: status, Seq: call.Seq, Req: call.Req}
+		call.Err = err
+		c.complete(call)
+	}
+
+	// a failed handshake is dealt with by whoever is connecting
+	if !lost || handshake {
+		return
+	}
+	c.state(StateDisconnected)
+	if c.cfg.Reconnect == nil {
+		// nothing more will arrive
+		c.closePush()
+		return
+	}
+	go func() { _ = c.reconnect(context.Background()) }()
+}
+
+// goaway handles notice from the server that it is closing conn,
+// because it is shutting down (status 197) or the conn has been idle
+// for too long (490). No new requests are sent on conn, but it is
+// left open so that responses to requests already in flight can
+// arrive; the server will close it when they have been sent.
+func (c *Client) goaway(conn *p.Conn, status uint16) {
+	c.mu.Lock()
+	if conn != c.conn || c.cc {
+		c.mu.Unlock()
+		return
+	}
 	c.cc = true
-	return c.conn.NC.Close()
+	c.cs = status
+	c.ga = true
+	c.mu.Unlock()
+	c.state(StateGoingAway)
+}
+
+// push hands a push message to the application, if there is room
+// for it
+func (c *Client) push(r *p.Resp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pc {
+		return
+	}
+	select {
+	case c.Push <- r:
+	default:
+		// no room; drop it
+	}
+}
+
+// closePush closes the Push channel, once
+func (c *Client) closePush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pc {
+		c.pc = true
+		close(c.Push)
+	}
+}
+
+// chunk handles a stream chunk which has arrived for a Call. Chunks
+// for a Stream are handed to its reader, blocking until there is room
+// for them; chunks for any other Call are accumulated, up to lim bytes
+// (if it is not zero). It returns false if the chunk would go over
+// that limit.
+func (cl *Call) chunk(r *p.Resp, lim uint32) bool {
+	if cl.ch == nil {
+		if lim > 0 && len(cl.buf)+len(r.Payload) > int(lim) {
+			return false
+		}
+		cl.buf = append(cl.buf, r.Payload...)
+		return true
+	}
+	cl.nin += len(r.Payload)
+	select {
+	case cl.ch <- r:
+	case <-cl.stop:
+		// the Stream has been closed, so drop the chunk
+	case <-cl.Done:
+		// the Call was failed, so drop the chunk
+	}
+	return true
+}
+
+// compression puts the Compressor named in a PROTOCHECK reply into
+// use on conn. The reply is the protocol version, followed by the
+// name, if the server chose one.
+func (c *Client) compression(conn *p.Conn, reply []byte) {
+	if len(reply) < 2 {
+		return
+	}
+	name := string(reply[1:])
+	if !slices.Contains(c.cfg.Compress, name) {
+		return
+	}
+	cmin := c.cfg.CompressMin
+	if cmin == 0 {
+		cmin = p.DefaultCompressMin
+	}
+	conn.SetCompression(p.GetCompressor(name), cmin)
+}
+
+// Compression returns the name of the Compressor in use on the
+// Client's connection, or "" if there is none.
+func (c *Client) Compression() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.Compression()
 }
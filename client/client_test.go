@@ -1,13 +1,20 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	//"log"
 	//"sync"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	p "github.com/firepear/petrel"
 	ps "github.com/firepear/petrel/server"
 )
 
@@ -259,6 +266,710 @@ func TestClientHighRCHandler(t *testing.T) {
 	c.Quit()
 }
 
+// send several requests at once over one connection, with the
+// slowest sent first, and make sure each gets its own response
+func TestClientDispatchAsync(t *testing.T) {
+	sn := "localhost:60606"
+
+	// stand up server
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	defer s.Quit()
+
+	c, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: %s", t.Name(), err)
+	}
+	defer c.Quit()
+
+	slow, err := c.DispatchAsync("sleep", []byte("50"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	fast, err := c.DispatchAsync("sleep", []byte("1"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	if slow.Seq == fast.Seq {
+		t.Errorf("%s: calls share seq %d", t.Name(), slow.Seq)
+	}
+
+	// the fast request should complete while the slow one is
+	// still in its handler
+	resp, err := fast.Wait()
+	if err != nil {
+		t.Errorf("%s: fast call failed: %s", t.Name(), err)
+	}
+	if string(resp.Payload) != "1" || resp.Seq != fast.Seq {
+		t.Errorf("%s: fast got wrong response: %d %s", t.Name(), resp.Seq, resp.Payload)
+	}
+	select {
+	case <-slow.Done:
+		t.Errorf("%s: slow call finished before fast call", t.Name())
+	default:
+	}
+	resp, err = slow.Wait()
+	if err != nil {
+		t.Errorf("%s: slow call failed: %s", t.Name(), err)
+	}
+	if string(resp.Payload) != "50" || resp.Seq != slow.Seq {
+		t.Errorf("%s: slow got wrong response: %d %s", t.Name(), resp.Seq, resp.Payload)
+	}
+
+	// and the synchronous interface still works alongside
+	err = c.Dispatch("sleep", []byte("2"))
+	if err != nil || string(c.Resp.Payload) != "2" {
+		t.Errorf("%s: dispatch failed: %s %s", t.Name(), err, c.Resp.Payload)
+	}
+
+	// concurrent Dispatches don't race on Resp, though it only
+	// holds one of their responses
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Dispatch("sleep", []byte(strconv.Itoa(i))); err != nil {
+				t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := strconv.Atoi(string(c.Resp.Payload)); err != nil || n < 0 || n > 9 {
+		t.Errorf("%s: bad Resp after concurrent dispatches: %s", t.Name(), c.Resp.Payload)
+	}
+}
+
+// a cancelled context abandons a request, but not the connection
+func TestClientDispatchCtx(t *testing.T) {
+	sn := "localhost:60606"
+
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	defer s.Quit()
+
+	c, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: %s", t.Name(), err)
+	}
+	defer c.Quit()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = c.DispatchCtx(ctx, "sleep", []byte("100"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("%s: expected deadline exceeded, got %v", t.Name(), err)
+	}
+	if c.Closed() {
+		t.Errorf("%s: abandoning a request closed the conn", t.Name())
+	}
+	// the late response to the abandoned request is dropped, and
+	// doesn't get mixed up with this one
+	err = c.DispatchCtx(context.Background(), "sleep", []byte("150"))
+	if err != nil || string(c.Resp.Payload) != "150" {
+		t.Errorf("%s: dispatch failed: %v %s", t.Name(), err, c.Resp.Payload)
+	}
+}
+
+// read a streamed response, as chunks and via io.Reader
+func TestClientStream(t *testing.T) {
+	sn := "localhost:60606"
+
+	// stand up server
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.RegisterStream("count", countHandler)
+	defer s.Quit()
+
+	c, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: %s", t.Name(), err)
+	}
+	defer c.Quit()
+
+	// iterate over chunks
+	st, err := c.DispatchStream("count", []byte("5"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	if st.Resp() != nil {
+		t.Errorf("%s: stream should not have ended yet", t.Name())
+	}
+	var chunks []string
+	for {
+		chunk, err := st.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("%s: stream failed: %s", t.Name(), err)
+			break
+		}
+		chunks = append(chunks, string(chunk))
+	}
+	if strings.Join(chunks, ",") != "0,1,2,3,4" {
+		t.Errorf("%s: wrong chunks: %v", t.Name(), chunks)
+	}
+	if st.Resp() == nil || st.Resp().Status != 200 || st.Resp().Flags != p.FlagEOS {
+		t.Errorf("%s: bad end-of-stream: %v", t.Name(), st.Resp())
+	}
+
+	// read it all at once
+	st, err = c.DispatchStream("count", []byte("12"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	b, err := io.ReadAll(st)
+	if err != nil || string(b) != "01234567891011" {
+		t.Errorf("%s: bad ReadAll: %s %s", t.Name(), err, b)
+	}
+
+	// a plain Dispatch gets the whole stream as its payload
+	err = c.Dispatch("count", []byte("3"))
+	if err != nil || string(c.Resp.Payload) != "012" {
+		t.Errorf("%s: bad Dispatch: %s %s", t.Name(), err, c.Resp.Payload)
+	}
+
+	// abandon a stream, then make sure the client still works
+	st, err = c.DispatchStream("count", []byte("100"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	st.Close()
+	err = c.Dispatch("count", []byte("2"))
+	if err != nil || string(c.Resp.Payload) != "01" {
+		t.Errorf("%s: bad Dispatch: %s %s", t.Name(), err, c.Resp.Payload)
+	}
+
+	// a plain Dispatch of a stream is held to Xferlim in total,
+	// and going over costs only that request
+	lc, err := New(&Config{Addr: sn, Xferlim: 100})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	defer lc.Quit()
+	err = lc.Dispatch("count", []byte("200"))
+	if err == nil || lc.Resp.Status != 402 {
+		t.Errorf("%s: oversize stream should be 402: %v %d", t.Name(), err, lc.Resp.Status)
+	}
+	err = lc.Dispatch("count", []byte("3"))
+	if err != nil || string(lc.Resp.Payload) != "012" {
+		t.Errorf("%s: bad Dispatch after 402: %v %s", t.Name(), err, lc.Resp.Payload)
+	}
+
+	// a stream which ends with any status but 200 results in a
+	// StatusError at the end of the stream. a Warn level one
+	// leaves the conn open
+	st, err = c.DispatchStream("count", []byte("-1"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	_, err = io.ReadAll(st)
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status != 422 || se.Req != "count" {
+		t.Errorf("%s: stream should have failed with 422: %v", t.Name(), err)
+	}
+	if c.Closed() {
+		t.Errorf("%s: client should still be open", t.Name())
+	}
+
+	// and so does a failing stream handler
+	st, err = c.DispatchStream("count", []byte("x"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	_, err = io.ReadAll(st)
+	if !errors.As(err, &se) || se.Status != 500 {
+		t.Errorf("%s: stream should have failed with 500: %v", t.Name(), err)
+	}
+}
+
+// receive pushes from the server
+func TestClientPush(t *testing.T) {
+	sn := "localhost:60606"
+
+	// stand up server
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	defer s.Quit()
+
+	c, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: %s", t.Name(), err)
+	}
+	ids := s.ConnIds()
+	if len(ids) != 1 {
+		t.Fatalf("%s: should have 1 conn, have %d", t.Name(), len(ids))
+	}
+	if err = s.Push("nope", "cfg", []byte{}); err == nil {
+		t.Errorf("%s: push to bad conn id should fail", t.Name())
+	}
+
+	// push while a request is in flight; the push should not
+	// be mistaken for the reply
+	call, _ := c.DispatchAsync("sleep", []byte("20"))
+	if err = s.Push(ids[0], "cfg", []byte("v2")); err != nil {
+		t.Errorf("%s: push failed: %s", t.Name(), err)
+	}
+	push := <-c.Push
+	if push.Req != "cfg" || string(push.Payload) != "v2" || push.Flags&p.FlagPush == 0 {
+		t.Errorf("%s: bad push: %v", t.Name(), push)
+	}
+	resp, err := call.Wait()
+	if err != nil || string(resp.Payload) != "20" {
+		t.Errorf("%s: bad reply: %s %v", t.Name(), err, resp)
+	}
+
+	// broadcast to two clients
+	c2, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: %s", t.Name(), err)
+	}
+	if n := s.Broadcast("hello", []byte("all")); n != 2 {
+		t.Errorf("%s: broadcast should reach 2 clients, got %d", t.Name(), n)
+	}
+	for _, cc := range []*Client{c, c2} {
+		push = <-cc.Push
+		if push.Req != "hello" || string(push.Payload) != "all" {
+			t.Errorf("%s: bad broadcast: %v", t.Name(), push)
+		}
+	}
+
+	// Push is closed along with the client
+	c.Quit()
+	c2.Quit()
+	if _, ok := <-c.Push; ok {
+		t.Errorf("%s: Push should be closed", t.Name())
+	}
+}
+
+// authenticate during the handshake
+func TestClientAuth(t *testing.T) {
+	sn := "localhost:60606"
+
+	// stand up server which wants a token
+	s, err := ps.New(&ps.Config{Addr: sn, Authenticator: tokenAuth})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.RegisterCtx("whoami", func(ctx context.Context, r *ps.Request) (uint16, []byte, error) {
+		return 200, []byte(r.Ident.Name), nil
+	})
+	defer s.Quit()
+
+	// no credentials, and bad credentials
+	for _, creds := range []*p.Credentials{nil, {Token: "wrong"}} {
+		c, err := New(&Config{Addr: sn, Credentials: creds})
+		if !strings.Contains(fmt.Sprintf("%s", err), "[496]") {
+			t.Errorf("%s: err should be 496 here: %s", t.Name(), err)
+		}
+		if c != nil {
+			t.Errorf("%s: c should be nil on 496", t.Name())
+		}
+	}
+
+	// good credentials
+	c, err := New(&Config{Addr: sn, Credentials: &p.Credentials{Token: "s3cret"}})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	err = c.Dispatch("whoami", nil)
+	if err != nil || string(c.Resp.Payload) != "alice" {
+		t.Errorf("%s: bad whoami: %s %s", t.Name(), err, c.Resp.Payload)
+	}
+	c.Quit()
+}
+
+// use a pool of clients, including recovering from a client which
+// closes itself
+func TestClientPool(t *testing.T) {
+	sn := "localhost:60606"
+
+	// stand up server
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	defer s.Quit()
+
+	if _, err = NewPool(&Config{Addr: sn}, 0); err == nil {
+		t.Errorf("%s: zero size pool should fail", t.Name())
+	}
+	pl, err := NewPool(&Config{Addr: sn}, 3)
+	if err != nil {
+		t.Fatalf("%s: couldn't create pool: %s", t.Name(), err)
+	}
+	st := pl.Stats()
+	if st.Idle != 3 || st.Dials != 3 || st.InUse != 0 {
+		t.Errorf("%s: bad initial stats: %+v", t.Name(), st)
+	}
+
+	// lots of concurrent dispatches
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := pl.Dispatch(context.Background(), "sleep", []byte(strconv.Itoa(i%3)))
+			if err != nil || string(resp.Payload) != strconv.Itoa(i%3) {
+				t.Errorf("%s: bad dispatch: %s %v", t.Name(), err, resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// check out a client, and break it with a bad request (the
+	// sleep handler errors on non-numeric input, which is a 500)
+	cl, err := pl.Get(context.Background())
+	if err != nil {
+		t.Fatalf("%s: get failed: %s", t.Name(), err)
+	}
+	if st = pl.Stats(); st.InUse != 1 || st.Idle != 2 {
+		t.Errorf("%s: bad stats: %+v", t.Name(), st)
+	}
+	_ = cl.Dispatch("sleep", []byte("x"))
+	if !cl.Closed() {
+		t.Errorf("%s: client should be closed after 500", t.Name())
+	}
+	pl.Put(cl)
+
+	// it gets replaced
+	for pl.Stats().Idle < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	st = pl.Stats()
+	if st.Discarded != 1 || st.Dials != 4 || st.InUse != 0 || st.Dialing != 0 {
+		t.Errorf("%s: bad stats after redial: %+v", t.Name(), st)
+	}
+
+	// an exhausted pool makes callers wait
+	var held []*Client
+	for range 3 {
+		cl, _ = pl.Get(context.Background())
+		held = append(held, cl)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = pl.Get(ctx); err != context.DeadlineExceeded {
+		t.Errorf("%s: get should have timed out: %v", t.Name(), err)
+	}
+	for _, cl = range held {
+		pl.Put(cl)
+	}
+
+	// a client broken while checked out is not replaced once
+	// the pool has quit
+	cl, _ = pl.Get(context.Background())
+	_ = cl.Dispatch("sleep", []byte("x"))
+	dials := pl.Stats().Dials
+	pl.Quit()
+	pl.Put(cl)
+	if st = pl.Stats(); st.Dialing != 0 || st.Dials != dials {
+		t.Errorf("%s: closed pool should not redial: %+v", t.Name(), st)
+	}
+	if _, err = pl.Get(context.Background()); err == nil {
+		t.Errorf("%s: get from closed pool should fail", t.Name())
+	}
+	for lenConns(s) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// an idle pooled client whose server stops answering is checked,
+// and replaced, before it is handed out
+func TestClientPoolCheck(t *testing.T) {
+	sn := "localhost:60606"
+	defer func(idle, wait time.Duration) {
+		poolCheckIdle, poolCheckWait = idle, wait
+	}(poolCheckIdle, poolCheckWait)
+	poolCheckIdle, poolCheckWait = 10*time.Millisecond, 50*time.Millisecond
+
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: server creation fail: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	// PINGs go unanswered, as they would from a dead peer
+	var mute atomic.Bool
+	s.RemoveHandler("PING")
+	_ = s.RegisterCtx("PING", func(ctx context.Context, _ *ps.Request) (uint16, []byte, error) {
+		if mute.Load() {
+			<-ctx.Done()
+		}
+		return 200, make([]byte, 8), nil
+	})
+
+	pl, err := NewPool(&Config{Addr: sn}, 1)
+	if err != nil {
+		t.Fatalf("%s: couldn't create pool: %s", t.Name(), err)
+	}
+	defer pl.Quit()
+
+	// a responsive client passes its check
+	time.Sleep(20 * time.Millisecond)
+	cl, err := pl.Get(context.Background())
+	if err != nil {
+		t.Fatalf("%s: get failed: %s", t.Name(), err)
+	}
+	pl.Put(cl)
+	if st := pl.Stats(); st.CheckFailures != 0 || st.Discarded != 0 {
+		t.Errorf("%s: client should have passed its check: %+v", t.Name(), st)
+	}
+
+	// an unresponsive one is replaced
+	mute.Store(true)
+	time.Sleep(20 * time.Millisecond)
+	cl2, err := pl.Get(context.Background())
+	if err != nil {
+		t.Fatalf("%s: get failed: %s", t.Name(), err)
+	}
+	if cl2 == cl || cl2.Closed() {
+		t.Errorf("%s: should have gotten a new client", t.Name())
+	}
+	if st := pl.Stats(); st.CheckFailures != 1 || st.Discarded != 1 || st.Dials != 2 {
+		t.Errorf("%s: bad stats after failed check: %+v", t.Name(), st)
+	}
+	pl.Put(cl2)
+}
+
+// reconnect after an error closes the connection, and resend an
+// idempotent request which lost its connection
+func TestClientReconnect(t *testing.T) {
+	sn := "localhost:60606"
+
+	// stand up server
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	// flaky is slow the first time it's called, and fast after
+	var calls atomic.Int32
+	flaky := func(r []byte) (uint16, []byte, error) {
+		if calls.Add(1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return 200, r, nil
+	}
+	_ = s.Register("flaky", flaky)
+	_ = s.Register("flaky2", flaky)
+	defer s.Quit()
+
+	var states []State
+	var smu sync.Mutex
+	c, err := New(&Config{Addr: sn, Timeout: 30,
+		Reconnect:  &RetryPolicy{Delay: 5 * time.Millisecond, Jitter: 0.5},
+		Idempotent: []string{"flaky"},
+		OnState: func(st State) {
+			smu.Lock()
+			states = append(states, st)
+			smu.Unlock()
+		}})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+
+	// a 500 closes the connection, but the next request reopens it
+	_ = c.Dispatch("sleep", []byte("x"))
+	if c.Resp.Status != 500 {
+		t.Errorf("%s: should have gotten 500: %d", t.Name(), c.Resp.Status)
+	}
+	err = c.Dispatch("sleep", []byte("1"))
+	if err != nil || string(c.Resp.Payload) != "1" {
+		t.Errorf("%s: dispatch after reconnect failed: %s", t.Name(), err)
+	}
+
+	// the first flaky call times out, closing the connection. as
+	// it is idempotent, it gets resent
+	err = c.Dispatch("flaky", []byte("ok"))
+	if err != nil || string(c.Resp.Payload) != "ok" {
+		t.Errorf("%s: flaky should have been resent: %s", t.Name(), err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%s: flaky should have been called twice, was %d", t.Name(), n)
+	}
+
+	// flaky2 is not idempotent, so its timeout is an error
+	calls.Store(0)
+	err = c.Dispatch("flaky2", []byte("ok"))
+	if err == nil || c.Resp.Status != 494 {
+		t.Errorf("%s: flaky2 should have timed out: %v %d", t.Name(), err, c.Resp.Status)
+	}
+
+	c.Quit()
+	if err = c.Dispatch("sleep", []byte("1")); err == nil {
+		t.Errorf("%s: dispatch after Quit should fail", t.Name())
+	}
+	smu.Lock()
+	got := fmt.Sprint(states)
+	smu.Unlock()
+	if !strings.HasPrefix(got, "[connected disconnected reconnecting connected disconnected") ||
+		!strings.HasSuffix(got, "closed]") {
+		t.Errorf("%s: bad state changes: %s", t.Name(), got)
+	}
+	for lenConns(s) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// a request waiting on a reconnect to a dead server gives up when
+// its ctx, or the Client's timeout, runs out, or when the
+// RetryPolicy's attempts are used up
+func TestClientReconnectGivesUp(t *testing.T) {
+	sn := "localhost:60606"
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: server creation fail: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	newClient := func(conf *Config) (*Client, chan struct{}) {
+		away := make(chan struct{}, 1)
+		conf.Addr = sn
+		conf.OnState = func(st State) {
+			if st == StateGoingAway || st == StateDisconnected {
+				select {
+				case away <- struct{}{}:
+				default:
+				}
+			}
+		}
+		c, err := New(conf)
+		if err != nil {
+			t.Fatalf("%s: %s", t.Name(), err)
+		}
+		return c, away
+	}
+	// c waits long between attempts, so that ctx or Timeout runs
+	// out first. g runs out of attempts quickly
+	c, caway := newClient(&Config{Timeout: 200,
+		Reconnect: &RetryPolicy{Attempts: 3, Delay: time.Second}})
+	defer c.Quit()
+	g, gaway := newClient(&Config{
+		Reconnect: &RetryPolicy{Attempts: 3, Delay: 5 * time.Millisecond}})
+	defer g.Quit()
+	if _, err = s.GracefulQuit(context.Background()); err != nil {
+		t.Fatalf("%s: server quit: %s", t.Name(), err)
+	}
+	<-caway
+	<-gaway
+
+	for _, tc := range []struct {
+		name string
+		ctx  time.Duration
+	}{{"ctx", 50 * time.Millisecond}, {"timeout", time.Hour}} {
+		ctx, cancel := context.WithTimeout(context.Background(), tc.ctx)
+		start := time.Now()
+		err = c.DispatchCtx(ctx, "sleep", []byte("1"))
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), "reconnect abandoned") {
+			t.Errorf("%s: %s: expected abandoned reconnect, got %v", t.Name(), tc.name, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: %s: took %s to give up", t.Name(), tc.name, d)
+		}
+	}
+
+	start := time.Now()
+	err = g.Dispatch("sleep", []byte("1"))
+	if err == nil || !strings.Contains(err.Error(), "reconnect failed") {
+		t.Errorf("%s: expected failed reconnect, got %v", t.Name(), err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("%s: took %s to give up", t.Name(), d)
+	}
+	if !g.Closed() {
+		t.Errorf("%s: client should be closed", t.Name())
+	}
+
+	c.Quit()
+	g.Quit()
+	for lenConns(s) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// PING round trips and clock offset
+func TestClientPing(t *testing.T) {
+	sn := "localhost:60606"
+	s, err := ps.New(&ps.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: server creation fail: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	c, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	defer c.Quit()
+	rtt, offset, err := c.Ping()
+	if err != nil {
+		t.Fatalf("%s: ping failed: %s", t.Name(), err)
+	}
+	// same host, same clock
+	if rtt <= 0 || rtt > time.Second || offset < -rtt || offset > rtt {
+		t.Errorf("%s: bad ping: rtt %s offset %s", t.Name(), rtt, offset)
+	}
+
+	// a server without PING
+	s.RemoveHandler("PING")
+	if _, _, err = c.Ping(); err == nil || !strings.Contains(err.Error(), "[400]") {
+		t.Errorf("%s: should have gotten 400: %s", t.Name(), err)
+	}
+}
+
+// keepalives keep an idle conn open, and notice a dead server
+func TestClientKeepalive(t *testing.T) {
+	sn := "localhost:60606"
+	s, err := ps.New(&ps.Config{Addr: sn, IdleTimeout: 60})
+	if err != nil {
+		t.Fatalf("%s: server creation fail: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("sleep", sleepHandler)
+
+	c, err := New(&Config{Addr: sn, Keepalive: 20})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err = c.Dispatch("sleep", []byte("1")); err != nil {
+		t.Errorf("%s: keepalives should have kept conn open: %s", t.Name(), err)
+	}
+	c.Quit()
+
+	// now make PING hang, as it would with a wedged server
+	s.RemoveHandler("PING")
+	_ = s.RegisterCtx("PING", func(ctx context.Context, _ *ps.Request) (uint16, []byte, error) {
+		<-ctx.Done()
+		return 200, nil, nil
+	})
+	c, err = New(&Config{Addr: sn, Keepalive: 20, KeepaliveMisses: 2})
+	if err != nil {
+		t.Fatalf("%s: %s", t.Name(), err)
+	}
+	defer c.Quit()
+	time.Sleep(40 * time.Millisecond)
+	if c.Closed() {
+		t.Errorf("%s: conn closed too soon", t.Name())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err = c.Dispatch("sleep", []byte("1")); err == nil || !strings.Contains(err.Error(), "489") {
+		t.Errorf("%s: should have gotten 489: %s", t.Name(), err)
+	}
+}
+
 // a replacement PROTOCHECK handler which always sends back a version
 // mismatch error
 func protoAlwaysMismatch(payload []byte) (uint16, []byte, error) {
@@ -281,3 +992,45 @@ func protoError(payload []byte) (uint16, []byte, error) {
 func appDefinedHandler(r []byte) (uint16, []byte, error) {
 	return 2222, r, nil
 }
+
+// sleepHandler sleeps for the number of milliseconds given in its
+// payload, then echoes the payload back
+func sleepHandler(r []byte) (uint16, []byte, error) {
+	ms, err := strconv.Atoi(string(r))
+	if err != nil {
+		return 0, nil, err
+	}
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return 200, r, nil
+}
+
+// countHandler streams the numbers from zero up to the number given
+// in its payload, one per chunk
+func countHandler(r []byte, w io.Writer) (uint16, error) {
+	n, err := strconv.Atoi(string(r))
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 422, nil
+	}
+	for i := range n {
+		if _, err = fmt.Fprint(w, i); err != nil {
+			return 0, err
+		}
+	}
+	return 200, nil
+}
+
+// tokenAuth is an Authenticator which accepts a single token
+func tokenAuth(creds *p.Credentials, r *ps.Request) (*p.Identity, error) {
+	if creds.Token != "s3cret" {
+		return nil, fmt.Errorf("bad token")
+	}
+	return &p.Identity{Name: "alice"}, nil
+}
+
+// lenConns returns the number of connections open on a server
+func lenConns(s *ps.Server) int {
+	return len(s.ConnIds())
+}
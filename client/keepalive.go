@@ -0,0 +1,98 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements PING and client keepalives.
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// Ping sends a PING request to the server. It returns the round-trip
+// time, and the offset of the server's clock from the Client's: a
+// positive offset means the server's clock is ahead. The offset
+// assumes the request and response took equal time in transit, so
+// it is only as accurate as the network is symmetrical.
+func (c *Client) Ping() (rtt, offset time.Duration, err error) {
+	start := time.Now()
+	call, err := c.DispatchAsync("PING", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := c.wait(call)
+	if err != nil {
+		return 0, 0, err
+	}
+	rtt = time.Since(start)
+	if resp.Status != 200 {
+		if resp.Status == 400 {
+			return rtt, 0, fmt.Errorf("[400] PING unsupported")
+		}
+		return rtt, 0, fmt.Errorf("[%d] PING failed", resp.Status)
+	}
+	if len(resp.Payload) != 8 {
+		return rtt, 0, fmt.Errorf("bad PING payload: %d bytes", len(resp.Payload))
+	}
+	srv := time.Unix(0, int64(binary.LittleEndian.Uint64(resp.Payload)))
+	return rtt, srv.Sub(start.Add(rtt / 2)), nil
+}
+
+// keepalive runs for the life of a Client configured with
+// Keepalive, sending a PING every interval. Any response counts, but
+// if enough PINGs in a row go unanswered, the connection is closed as
+// dead.
+func (c *Client) keepalive() {
+	interval := time.Duration(c.cfg.Keepalive) * time.Millisecond
+	limit := c.cfg.KeepaliveMisses
+	if limit == 0 {
+		limit = 3
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	misses := 0
+	for {
+		select {
+		case <-c.q:
+			return
+		case <-tick.C:
+		}
+		// there is nothing to check while the conn is closed,
+		// and a PING should not cause a reconnect
+		c.mu.Lock()
+		conn, closed := c.conn, c.cc
+		c.mu.Unlock()
+		if closed {
+			misses = 0
+			continue
+		}
+		// keepalives are sent untraced, so that they do not
+		// clutter up a Tracer's output
+		call := &Call{Req: "PING", Done: make(chan struct{})}
+		if err := c.send(context.Background(), call, nil); err != nil {
+			continue
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-call.Done:
+			misses = 0
+		case <-timer.C:
+			misses++
+		case <-c.q:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+		if misses >= limit {
+			c.closeConn(conn, 489, fmt.Errorf("%s: %d PINGs unanswered",
+				p.Stats[489].Txt, misses))
+			misses = 0
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements client connection pools.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// Pool is a set of Clients connected to one server. Clients are
+// checked out with Get and returned with Put, or a Pool can Dispatch
+// requests itself, handling checkout and return.
+//
+// Clients which have closed their connections, whether because of an
+// Error level status or a network failure, are discarded when they
+// are returned to the Pool. So are Clients which have been idle for
+// more than a second, and then fail to answer a PING within two
+// seconds when they are next checked out. A replacement is dialed in
+// the background, and the Pool's size is restored when it connects.
+type Pool struct {
+	cfg  *Config
+	size int
+	idle chan idler
+	q    chan struct{}
+	w    sync.WaitGroup
+	mu   sync.Mutex
+	// the Pool has quit. it is set under mu, so that no redial
+	// can be added to w once Quit is waiting on it
+	quit bool
+	st   PoolStats
+}
+
+var (
+	// how long a Client may sit idle in a Pool before it is
+	// checked with a PING on checkout
+	poolCheckIdle = time.Second
+	// how long a checkout PING may take
+	poolCheckWait = 2 * time.Second
+)
+
+// idler is an idle Client, and when it went idle
+type idler struct {
+	cl *Client
+	t  time.Time
+}
+
+// PoolStats is a snapshot of a Pool's state and history.
+type PoolStats struct {
+	// Size is the number of Clients the Pool tries to keep
+	Size int
+	// Idle is the number of Clients available for checkout
+	Idle int
+	// InUse is the number of Clients currently checked out
+	InUse int
+	// Dialing is the number of replacement Clients being dialed
+	Dialing int
+	// Dials is the number of successful connections made
+	Dials int
+	// DialFailures is the number of failed connection attempts
+	DialFailures int
+	// Discarded is the number of closed Clients thrown away
+	Discarded int
+	// CheckFailures is the number of idle Clients which failed
+	// their PING on checkout. They are counted in Discarded too
+	CheckFailures int
+}
+
+// NewPool returns a Pool of 'size' Clients, all created with
+// configuration 'c'. If no Clients can be created, it returns the
+// last error encountered. If only some can be, the rest are dialed
+// in the background.
+func NewPool(c *Config, size int) (*Pool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid pool size %d", size)
+	}
+	pl := &Pool{
+		cfg:  c,
+		size: size,
+		idle: make(chan idler, size),
+		q:    make(chan struct{}),
+		st:   PoolStats{Size: size},
+	}
+	var err error
+	failed := 0
+	for range size {
+		var cl *Client
+		cl, err = New(c)
+		if err != nil {
+			failed++
+			continue
+		}
+		pl.idle <- idler{cl, time.Now()}
+	}
+	pl.mu.Lock()
+	pl.st.Dials = size - failed
+	pl.st.DialFailures = failed
+	pl.mu.Unlock()
+	if failed == size {
+		return nil, err
+	}
+	for range failed {
+		pl.redial()
+	}
+	return pl, nil
+}
+
+// Get checks out a Client, waiting until one is available or ctx is
+// done. The Client must be returned with Put when the caller is
+// finished with it.
+func (pl *Pool) Get(ctx context.Context) (*Client, error) {
+	for {
+		select {
+		case <-pl.q:
+			return nil, fmt.Errorf("pool is closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case it := <-pl.idle:
+			cl := it.cl
+			if cl.Closed() {
+				// it died while idle
+				pl.discard(cl)
+				continue
+			}
+			if time.Since(it.t) > poolCheckIdle {
+				if err := pl.check(ctx, cl); err != nil {
+					if ctx.Err() != nil {
+						// the caller gave up, not
+						// the Client
+						select {
+						case pl.idle <- it:
+						default:
+							_ = cl.Quit()
+						}
+						return nil, ctx.Err()
+					}
+					pl.mu.Lock()
+					pl.st.CheckFailures++
+					pl.mu.Unlock()
+					pl.discard(cl)
+					continue
+				}
+			}
+			pl.mu.Lock()
+			pl.st.InUse++
+			pl.mu.Unlock()
+			return cl, nil
+		}
+	}
+}
+
+// Put returns a Client to the Pool. If the Client has closed its
+// connection, it is discarded and a replacement is dialed.
+func (pl *Pool) Put(cl *Client) {
+	pl.mu.Lock()
+	pl.st.InUse--
+	pl.mu.Unlock()
+	if cl.Closed() {
+		pl.discard(cl)
+		return
+	}
+	select {
+	case <-pl.q:
+		_ = cl.Quit()
+		return
+	default:
+	}
+	select {
+	case pl.idle <- idler{cl, time.Now()}:
+	default:
+		// the pool is full; this is not one of ours
+		_ = cl.Quit()
+	}
+}
+
+// Dispatch checks out a Client, uses it to Dispatch a request, and
+// returns it to the Pool. ctx limits only the wait for a Client to
+// become available, though if it carries a Trace, the request is
+// sent as part of that trace. The returned Resp belongs to the
+// caller.
+func (pl *Pool) Dispatch(ctx context.Context, req string, payload []byte) (*p.Resp, error) {
+	cl, err := pl.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer pl.Put(cl)
+	err = cl.DispatchCtx(context.WithoutCancel(ctx), req, payload)
+	resp := *cl.Resp
+	return &resp, err
+}
+
+// Stats returns a snapshot of the Pool's state.
+func (pl *Pool) Stats() PoolStats {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	st := pl.st
+	st.Idle = len(pl.idle)
+	return st
+}
+
+// Quit shuts down the Pool, closing all idle Clients and stopping any
+// redials. Clients which are checked out are closed when they are
+// returned.
+func (pl *Pool) Quit() {
+	pl.mu.Lock()
+	if !pl.quit {
+		pl.quit = true
+		close(pl.q)
+	}
+	pl.mu.Unlock()
+	pl.w.Wait()
+	for {
+		select {
+		case it := <-pl.idle:
+			_ = it.cl.Quit()
+		default:
+			return
+		}
+	}
+}
+
+// check sends a PING on a Client which has been sitting idle. A
+// connection to a peer which has gone away can look healthy until
+// something is sent on it, and it is better that this is found out
+// here than by the caller's request. Any response will do, as with
+// keepalives.
+func (pl *Pool) check(ctx context.Context, cl *Client) error {
+	ctx, cancel := context.WithTimeout(ctx, poolCheckWait)
+	defer cancel()
+	// checks are sent untraced, as keepalives are
+	call := &Call{Req: "PING", Done: make(chan struct{})}
+	if err := cl.send(ctx, call, nil); err != nil {
+		return err
+	}
+	_, err := cl.waitCtx(ctx, call)
+	return err
+}
+
+// discard throws away a closed or unresponsive Client and dials its
+// replacement
+func (pl *Pool) discard(cl *Client) {
+	_ = cl.Quit()
+	pl.mu.Lock()
+	pl.st.Discarded++
+	pl.mu.Unlock()
+	pl.redial()
+}
+
+// redial launches a goroutine which dials a replacement Client,
+// backing off between failed attempts, and adds it to the Pool. Once
+// the Pool has quit, it does nothing.
+func (pl *Pool) redial() {
+	pl.mu.Lock()
+	if pl.quit {
+		pl.mu.Unlock()
+		return
+	}
+	pl.st.Dialing++
+	pl.w.Add(1)
+	pl.mu.Unlock()
+	go func() {
+		defer pl.w.Done()
+		defer func() {
+			pl.mu.Lock()
+			pl.st.Dialing--
+			pl.mu.Unlock()
+		}()
+		delay := 50 * time.Millisecond
+		for {
+			cl, err := New(pl.cfg)
+			pl.mu.Lock()
+			if err == nil {
+				pl.st.Dials++
+			} else {
+				pl.st.DialFailures++
+			}
+			pl.mu.Unlock()
+			if err == nil {
+				select {
+				case <-pl.q:
+					_ = cl.Quit()
+				case pl.idle <- idler{cl, time.Now()}:
+				}
+				return
+			}
+			select {
+			case <-pl.q:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, 5*time.Second)
+		}
+	}()
+}
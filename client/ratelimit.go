@@ -0,0 +1,40 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Rate limit errors
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// RateLimitError is the error returned when a server refuses a request
+// because a rate limit has been exceeded (status 429). The Client's
+// connection remains open, and the request may be tried again once
+// RetryAfter has passed.
+type RateLimitError struct {
+	// Req is the name of the request which was refused
+	Req string
+	// RetryAfter is how long the server suggested waiting before
+	// trying again. It is zero if the server gave no hint.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("[429] %s: %s: retry after %s", p.Stats[429].Txt,
+		e.Req, e.RetryAfter)
+}
+
+// rateLimited builds a RateLimitError from a 429 response, whose
+// payload is the retry hint in milliseconds
+func rateLimited(resp *p.Resp) error {
+	ms, _ := strconv.ParseInt(string(resp.Payload), 10, 64)
+	return &RateLimitError{Req: resp.Req,
+		RetryAfter: time.Duration(ms) * time.Millisecond}
+}
@@ -0,0 +1,176 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements client reconnection.
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// RetryPolicy controls how a Client reconnects. Attempts are spaced
+// out with exponential backoff: the first retry waits Delay, and
+// each one after that waits twice as long as the last, up to
+// MaxDelay.
+type RetryPolicy struct {
+	// Attempts is the maximum number of connection attempts made
+	// each time the connection is lost. If they all fail, the
+	// Client stays closed until the next Dispatch, which starts
+	// a new round. Default (0) is 10; a negative value is
+	// unlimited.
+	Attempts int
+
+	// Delay is the wait before the first retry. Default (0) is
+	// 100ms.
+	Delay time.Duration
+
+	// MaxDelay is the longest wait between attempts. Default (0)
+	// is 10s.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of each wait, from 0 to 1, which is
+	// randomized, so that many clients which lost their
+	// connections at once do not all retry at once. Default (0)
+	// is no jitter.
+	Jitter float64
+
+	// Resends is the number of times Dispatch will resend an
+	// idempotent request whose connection was lost. Default (0)
+	// is 1.
+	Resends int
+}
+
+// State is the connection state of a Client.
+type State int
+
+const (
+	// StateConnected means the Client has a working connection
+	StateConnected State = iota
+	// StateDisconnected means the connection has been lost
+	StateDisconnected
+	// StateReconnecting means a connection attempt is underway
+	StateReconnecting
+	// StateClosed means Quit has been called
+	StateClosed
+	// StateGoingAway means the server has said it is shutting
+	// down. No new requests can be sent, but responses to
+	// requests already in flight will still arrive
+	StateGoingAway
+)
+
+// String implements fmt.Stringer for State.
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	case StateGoingAway:
+		return "going away"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// state reports a state change to the application
+func (c *Client) state(s State) {
+	if c.cfg.OnState != nil {
+		c.cfg.OnState(s)
+	}
+}
+
+// reconnect reopens the Client's connection, retrying according to
+// its RetryPolicy. If another goroutine is already reconnecting, it
+// waits for that attempt instead of starting its own. Either way, it
+// gives up when ctx is done.
+func (c *Client) reconnect(ctx context.Context) error {
+	select {
+	case c.rc <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("reconnect abandoned: %w", ctx.Err())
+	case <-c.q:
+		return fmt.Errorf("client has quit")
+	}
+	defer func() { <-c.rc }()
+	if !c.Closed() {
+		// someone beat us to it
+		return nil
+	}
+
+	pol := c.cfg.Reconnect
+	delay := pol.Delay
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	maxDelay := pol.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = 10 * time.Second
+	}
+
+	attempts := pol.Attempts
+	if attempts == 0 {
+		attempts = 10
+	}
+
+	var err error
+	for attempt := 1; attempts < 0 || attempt <= attempts; attempt++ {
+		select {
+		case <-c.q:
+			return fmt.Errorf("client has quit")
+		case <-ctx.Done():
+			return fmt.Errorf("reconnect abandoned: %w", ctx.Err())
+		default:
+		}
+		c.state(StateReconnecting)
+		if err = c.connect(ctx); err == nil {
+			c.state(StateConnected)
+			return nil
+		}
+		c.state(StateDisconnected)
+		if attempt == attempts {
+			break
+		}
+		select {
+		case <-c.q:
+			return fmt.Errorf("client has quit")
+		case <-ctx.Done():
+			return fmt.Errorf("reconnect abandoned: %w", ctx.Err())
+		case <-time.After(jitter(delay, pol.Jitter)):
+		}
+		delay = min(delay*2, maxDelay)
+	}
+	return fmt.Errorf("reconnect failed: %w", err)
+}
+
+// resendable reports whether a request which failed without a
+// response may be resent, given how many times it already has been
+func (c *Client) resendable(req string, resends int) bool {
+	pol := c.cfg.Reconnect
+	if pol == nil || !slices.Contains(c.cfg.Idempotent, req) {
+		return false
+	}
+	max := pol.Resends
+	if max == 0 {
+		max = 1
+	}
+	return resends < max
+}
+
+// jitter randomizes the fraction j of duration d
+func jitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 {
+		return d
+	}
+	j = min(j, 1)
+	fixed := time.Duration(float64(d) * (1 - j))
+	return fixed + time.Duration(rand.Int64N(int64(float64(d)*j)+1))
+}
@@ -0,0 +1,108 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements client-side handling of streamed responses.
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	p "github.com/firepear/petrel"
+)
+
+// Stream is a response which is being streamed from a server
+// StreamHandler. It implements io.Reader over the concatenated stream
+// chunks, and Next can be used to iterate over the chunks
+// themselves. Chunks are consumed as they arrive; at most a few of
+// them are buffered at any time.
+//
+// Read and Next return io.EOF once the end-of-stream marker has been
+// received. If the stream ends with any status other than 200, they
+// return a *StatusError instead.
+type Stream struct {
+	call *Call
+	cur  []byte
+	once sync.Once
+}
+
+// DispatchStream sends a request whose handler on the server is a
+// StreamHandler, and returns a Stream from which the response may be
+// read.
+//
+// A Stream which is not read to its end should be closed, or its
+// unread chunks will eventually block the delivery of all other
+// responses on the Client.
+func (c *Client) DispatchStream(req string, payload []byte) (*Stream, error) {
+	call := &Call{Req: req, Done: make(chan struct{}),
+		ch: make(chan *p.Resp, 16), stop: make(chan struct{})}
+	err := c.start(context.Background(), call, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{call: call}, nil
+}
+
+// Next returns the next chunk of the stream.
+func (s *Stream) Next() ([]byte, error) {
+	select {
+	case r := <-s.call.ch:
+		return r.Payload, nil
+	case <-s.call.Done:
+		// the stream is over, but chunks which arrived before
+		// its end may still be buffered
+		select {
+		case r := <-s.call.ch:
+			return r.Payload, nil
+		default:
+		}
+		return nil, s.end()
+	}
+}
+
+// Read implements io.Reader.
+func (s *Stream) Read(b []byte) (int, error) {
+	for len(s.cur) == 0 {
+		chunk, err := s.Next()
+		if err != nil {
+			return 0, err
+		}
+		s.cur = chunk
+	}
+	n := copy(b, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+// Resp returns the end-of-stream response, which holds the final
+// status of the stream. It returns nil until the stream has ended.
+func (s *Stream) Resp() *p.Resp {
+	select {
+	case <-s.call.Done:
+		return s.call.Resp
+	default:
+		return nil
+	}
+}
+
+// Close abandons the stream. Any chunks which arrive after Close is
+// called are discarded.
+func (s *Stream) Close() error {
+	s.once.Do(func() { close(s.call.stop) })
+	return nil
+}
+
+// end returns the error which a finished stream should report to its
+// reader
+func (s *Stream) end() error {
+	if s.call.Err != nil {
+		return s.call.Err
+	}
+	if r := s.call.Resp; r.Status != 200 {
+		return &StatusError{Req: s.call.Req, Status: r.Status, Payload: r.Payload}
+	}
+	return io.EOF
+}
@@ -0,0 +1,57 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Request tracing
+
+import (
+	"context"
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// start sends a Call, tracing it if ctx carries a Trace or if the
+// Client has a Tracer. A traced Call gets a span of its own, which
+// is a child of the Trace in ctx if there is one.
+func (c *Client) start(ctx context.Context, call *Call, payload []byte) error {
+	parent, ok := p.TraceFromContext(ctx)
+	_, nop := c.tr.(p.NopTracer)
+	if ok || !nop {
+		if ok {
+			call.trace = parent.Child()
+		} else {
+			call.trace = p.NewTrace()
+		}
+		call.span = &p.Span{Trace: call.trace.ID, ID: call.trace.Span,
+			Parent: parent.Span, Kind: "client", Name: call.Req,
+			Start: time.Now(), BytesOut: len(payload)}
+		c.tr.SpanStart(call.span)
+	}
+	err := c.send(ctx, call, payload)
+	if err != nil && call.span != nil {
+		call.span.End = time.Now()
+		call.span.Err = err
+		c.tr.SpanEnd(call.span)
+	}
+	return err
+}
+
+// complete marks a Call as done, ending its span if it has one
+func (c *Client) complete(call *Call) {
+	if s := call.span; s != nil {
+		s.End = time.Now()
+		if call.conn != nil && call.conn.NC != nil {
+			s.Peer = call.conn.NC.RemoteAddr().String()
+		}
+		if call.Resp != nil {
+			s.Status = call.Resp.Status
+			s.BytesIn = len(call.Resp.Payload) + call.nin
+		}
+		s.Err = call.Err
+		c.tr.SpanEnd(s)
+	}
+	close(call.Done)
+}
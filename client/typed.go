@@ -0,0 +1,110 @@
+package client
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Typed requests
+
+import (
+	"context"
+	"fmt"
+
+	p "github.com/firepear/petrel"
+)
+
+// StatusError is the error returned by DispatchTyped when a request gets a
+// response with a status other than 200.
+type StatusError struct {
+	// Req is the name of the request
+	Req string
+	// Status is the response status
+	Status uint16
+	// Payload is the response payload. For status 422 (bad
+	// request), and for statuses returned by typed handlers as a
+	// server.StatusError, it says what went wrong.
+	Payload []byte
+}
+
+func (e *StatusError) Error() string {
+	txt := "app defined code"
+	if st, ok := p.Stats[e.Status]; ok {
+		txt = st.Txt
+	}
+	if len(e.Payload) > 0 {
+		return fmt.Sprintf("[%d] %s: %s: %s", e.Status, txt, e.Req, e.Payload)
+	}
+	return fmt.Sprintf("[%d] %s: %s", e.Status, txt, e.Req)
+}
+
+// DispatchTyped sends a request whose payload is req, encoded with
+// the Client's Codec, and decodes the response payload as a Resp. It
+// is the client side of server.RegisterTyped:
+//
+//	sum, err := client.DispatchTyped[Args, int](c, "add", Args{2, 3})
+//
+// A response with any status but 200 is returned as a *StatusError
+// (or a *RateLimitError, for status 429). Unlike Dispatch,
+// DispatchTyped does not set Client.Resp, so it is safe to use from
+// many goroutines at once.
+func DispatchTyped[Req, Resp any](c *Client, name string, req Req) (Resp, error) {
+	return DispatchTypedCtx[Req, Resp](context.Background(), c, name, req)
+}
+
+// DispatchTypedCtx is DispatchTyped with a context, which is used as
+// it is by DispatchCtx.
+func DispatchTypedCtx[Req, Resp any](ctx context.Context, c *Client, name string, req Req) (Resp, error) {
+	var out Resp
+	err := c.dispatchCodec(ctx, name, req, &out)
+	return out, err
+}
+
+// dispatchCodec sends req, encoded with the Client's Codec, and
+// decodes the response payload into out, which is a pointer
+func (c *Client) dispatchCodec(ctx context.Context, name string, req, out any) error {
+	payload, err := c.cdc.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("couldn't encode %s request (%s): %w",
+			name, c.cdc.Name(), err)
+	}
+	resp, err := c.roundTrip(ctx, name, payload)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 200 {
+		return &StatusError{Req: name, Status: resp.Status,
+			Payload: resp.Payload}
+	}
+	if err = c.cdc.Unmarshal(resp.Payload, out); err != nil {
+		return fmt.Errorf("couldn't decode %s response (%s): %w",
+			name, c.cdc.Name(), err)
+	}
+	return nil
+}
+
+// Service is a client stub for a service registered on a server with
+// RegisterService. It calls the service's methods by name:
+//
+//	arith := client.NewService(c, "Arith")
+//	var quo Quotient
+//	err := arith.Call(ctx, "Divide", &Args{7, 2}, &quo)
+type Service struct {
+	c      *Client
+	prefix string
+}
+
+// NewService returns a stub for the service registered under prefix,
+// which makes its requests with c.
+func NewService(c *Client, prefix string) *Service {
+	return &Service{c: c, prefix: prefix}
+}
+
+// Call calls the named method of the service, with args as its
+// argument, and decodes its reply into reply, which must be a
+// pointer. Errors are as for DispatchTyped; an error returned by the
+// method itself arrives as a *StatusError with status 520 (or the
+// status of a server.StatusError), whose Payload is the error's
+// text. Unlike a 500, it leaves the connection open.
+func (s *Service) Call(ctx context.Context, method string, args, reply any) error {
+	return s.c.dispatchCodec(ctx, s.prefix+"."+method, args, reply)
+}
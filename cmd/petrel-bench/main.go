@@ -0,0 +1,448 @@
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Command petrel-bench puts load on a petrel server and reports how
+// it held up.
+//
+//	petrel-bench [flags]
+//
+// It opens -conns connections, and sends -req requests over them,
+// with payloads of the sizes listed in -size, until -n requests have
+// been sent or -duration has passed. Requests are sent as fast as
+// the server will answer them, or at a total of -rate per second.
+//
+// With -echo, it first starts an echo server of its own at -addr,
+// so that the overhead of petrel itself can be measured.
+//
+// The report covers throughput, latency percentiles, response
+// statuses, and errors, as text or (with -json) as JSON.
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p "github.com/firepear/petrel"
+	pc "github.com/firepear/petrel/client"
+	ps "github.com/firepear/petrel/server"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// opts holds the command's flags
+type opts struct {
+	addr     string
+	network  string
+	conns    int
+	req      string
+	sizes    []int
+	n        int64
+	duration time.Duration
+	rate     float64
+	timeout  time.Duration
+	hmacEnv  string
+	tls      bool
+	ca       string
+	insecure bool
+	echo     bool
+	json     bool
+}
+
+// result is the outcome of one request
+type result struct {
+	lat    time.Duration
+	status uint16
+	err    error
+}
+
+// worker is one connection's share of the load
+type worker struct {
+	lat      []time.Duration
+	statuses map[uint16]int
+	errs     map[string]int
+	in, out  int64
+}
+
+// Latency is a latency summary, in milliseconds
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+// Report is the outcome of a run
+type Report struct {
+	Addr       string         `json:"addr"`
+	Req        string         `json:"req"`
+	Conns      int            `json:"conns"`
+	Sizes      []int          `json:"sizes"`
+	Requests   int64          `json:"requests"`
+	Errors     int64          `json:"errors"`
+	Seconds    float64        `json:"seconds"`
+	Throughput float64        `json:"throughput"`
+	BytesOut   int64          `json:"bytes_out"`
+	BytesIn    int64          `json:"bytes_in"`
+	Latency    Latency        `json:"latency_ms"`
+	Statuses   map[uint16]int `json:"statuses"`
+	ErrorTexts map[string]int `json:"error_texts,omitempty"`
+}
+
+// run is main, minus the process. It returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	o, err := parseFlags(args, stderr)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(stderr, "petrel-bench: %s\n", err)
+		return 2
+	}
+	var key []byte
+	if o.hmacEnv != "" {
+		k, ok := os.LookupEnv(o.hmacEnv)
+		if !ok || k == "" {
+			fmt.Fprintf(stderr, "petrel-bench: HMAC key variable %s is not set\n", o.hmacEnv)
+			return 1
+		}
+		key = []byte(k)
+	}
+
+	if o.echo {
+		s, err := echoServer(o, key)
+		if err != nil {
+			fmt.Fprintf(stderr, "petrel-bench: couldn't start echo server: %s\n", err)
+			return 1
+		}
+		defer s.Quit()
+	}
+
+	rep, err := bench(o, key)
+	if err != nil {
+		fmt.Fprintf(stderr, "petrel-bench: %s\n", err)
+		return 1
+	}
+	if o.json {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	} else {
+		rep.write(stdout)
+	}
+	return 0
+}
+
+// parseFlags parses the command line
+func parseFlags(args []string, stderr io.Writer) (*opts, error) {
+	o := &opts{}
+	var sizes string
+	fs := flag.NewFlagSet("petrel-bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&o.addr, "addr", "localhost:60606", "server address")
+	fs.StringVar(&o.network, "network", "tcp", "network type: tcp or unix")
+	fs.IntVar(&o.conns, "conns", 10, "number of connections")
+	fs.StringVar(&o.req, "req", "echo", "request name")
+	fs.StringVar(&sizes, "size", "64", "comma-separated payload sizes, in bytes, used in turn")
+	fs.Int64Var(&o.n, "n", 0, "number of requests to send (0: run for -duration)")
+	fs.DurationVar(&o.duration, "duration", 10*time.Second, "how long to run, if -n is 0")
+	fs.Float64Var(&o.rate, "rate", 0, "total requests per second (0: as fast as possible)")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "request timeout")
+	fs.StringVar(&o.hmacEnv, "hmac-env", "", "name of an environment variable holding the HMAC key")
+	fs.BoolVar(&o.tls, "tls", false, "connect with TLS (implied by -ca and -insecure)")
+	fs.StringVar(&o.ca, "ca", "", "PEM file of CA certificates to verify the server with")
+	fs.BoolVar(&o.insecure, "insecure", false, "don't verify the server's certificate")
+	fs.BoolVar(&o.echo, "echo", false, "start an in-process echo server at -addr")
+	fs.BoolVar(&o.json, "json", false, "report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	for _, sz := range strings.Split(sizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(sz))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad payload size %q", sz)
+		}
+		o.sizes = append(o.sizes, n)
+	}
+	if o.conns < 1 {
+		return nil, fmt.Errorf("-conns must be at least 1")
+	}
+	if o.echo && (o.tls || o.ca != "" || o.insecure) {
+		return nil, fmt.Errorf("the echo server does not do TLS")
+	}
+	return o, nil
+}
+
+// echoServer starts a server which answers o.req by echoing its
+// payload
+func echoServer(o *opts, key []byte) (*ps.Server, error) {
+	s, err := ps.New(&ps.Config{Addr: o.addr, Network: o.network, HMACKey: key,
+		Buffer: 1024,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Register(o.req, func(pl []byte) (uint16, []byte, error) {
+		return 200, pl, nil
+	})
+	if err != nil {
+		s.Quit()
+		return nil, err
+	}
+	return s, nil
+}
+
+// config builds the client Config for each connection
+func (o *opts) config(key []byte) (*pc.Config, error) {
+	conf := &pc.Config{Addr: o.addr, Network: o.network, HMACKey: key,
+		Timeout:   o.timeout.Milliseconds(),
+		Reconnect: &pc.RetryPolicy{Attempts: 3, Jitter: 0.5}}
+	if !o.tls && o.ca == "" && !o.insecure {
+		return conf, nil
+	}
+	conf.TLS = &tls.Config{InsecureSkipVerify: o.insecure}
+	if o.ca != "" {
+		pem, err := os.ReadFile(o.ca)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA file: %w", err)
+		}
+		conf.TLS.RootCAs = x509.NewCertPool()
+		if !conf.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.ca)
+		}
+	}
+	return conf, nil
+}
+
+// bench runs the benchmark
+func bench(o *opts, key []byte) (*Report, error) {
+	conf, err := o.config(key)
+	if err != nil {
+		return nil, err
+	}
+	clients := make([]*pc.Client, o.conns)
+	for i := range clients {
+		if clients[i], err = pc.New(conf); err != nil {
+			for _, c := range clients[:i] {
+				_ = c.Quit()
+			}
+			return nil, fmt.Errorf("couldn't connect to %s: %w", o.addr, err)
+		}
+	}
+	defer func() {
+		for _, c := range clients {
+			_ = c.Quit()
+		}
+	}()
+
+	payloads := make([][]byte, len(o.sizes))
+	for i, sz := range o.sizes {
+		payloads[i] = make([]byte, sz)
+		for j := range payloads[i] {
+			payloads[i][j] = byte(rand.IntN(256))
+		}
+	}
+
+	// a request may be sent when a token is taken from next. with
+	// no rate limit, the channel is closed, so takes never block
+	done := make(chan struct{})
+	next := make(chan struct{})
+	if o.rate > 0 {
+		go pace(o.rate, next, done)
+	} else {
+		close(next)
+	}
+	if o.n == 0 {
+		time.AfterFunc(o.duration, func() { close(done) })
+	}
+
+	var sent atomic.Int64
+	workers := make([]*worker, o.conns)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, c := range clients {
+		w := &worker{statuses: map[uint16]int{}, errs: map[string]int{}}
+		workers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-next:
+				}
+				k := sent.Add(1)
+				if o.n > 0 && k > o.n {
+					return
+				}
+				pl := payloads[int(k)%len(payloads)]
+				r, resp := send(c, o.req, pl, o.timeout)
+				w.record(r, resp, len(pl))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if o.n > 0 {
+		close(done)
+	}
+	return o.report(workers, elapsed), nil
+}
+
+// pace sends tokens on next at rate per second, until done is closed
+func pace(rate float64, next chan<- struct{}, done <-chan struct{}) {
+	interval := time.Duration(float64(time.Second) / rate)
+	start := time.Now()
+	for i := int64(1); ; i++ {
+		// tokens are scheduled from the start time rather
+		// than the last token, so that delays don't
+		// accumulate
+		time.Sleep(time.Until(start.Add(time.Duration(i) * interval)))
+		select {
+		case next <- struct{}{}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// send makes one request, giving up on it after timeout (if it is
+// not zero)
+func send(c *pc.Client, req string, pl []byte, timeout time.Duration) (result, *p.Resp) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	t := time.Now()
+	resp, err := c.RoundTrip(ctx, req, pl)
+	if resp == nil {
+		return result{lat: time.Since(t), err: err}, nil
+	}
+	return result{lat: time.Since(t), status: resp.Status, err: err}, resp
+}
+
+// record adds the outcome of a request to the worker's tallies
+func (w *worker) record(r result, resp *p.Resp, out int) {
+	w.out += int64(out)
+	if r.err != nil {
+		w.errs[r.err.Error()]++
+		return
+	}
+	w.lat = append(w.lat, r.lat)
+	w.statuses[r.status]++
+	w.in += int64(len(resp.Payload))
+}
+
+// report combines the workers' tallies
+func (o *opts) report(workers []*worker, elapsed time.Duration) *Report {
+	rep := &Report{Addr: o.addr, Req: o.req, Conns: o.conns, Sizes: o.sizes,
+		Seconds: elapsed.Seconds(), Statuses: map[uint16]int{},
+		ErrorTexts: map[string]int{}}
+	var lat []time.Duration
+	for _, w := range workers {
+		lat = append(lat, w.lat...)
+		rep.BytesIn += w.in
+		rep.BytesOut += w.out
+		for st, n := range w.statuses {
+			rep.Statuses[st] += n
+			rep.Requests += int64(n)
+		}
+		for txt, n := range w.errs {
+			rep.ErrorTexts[txt] += n
+			rep.Errors += int64(n)
+		}
+	}
+	rep.Throughput = float64(rep.Requests) / elapsed.Seconds()
+	if len(lat) == 0 {
+		return rep
+	}
+	slices.Sort(lat)
+	var sum time.Duration
+	for _, l := range lat {
+		sum += l
+	}
+	rep.Latency = Latency{
+		Min:  ms(lat[0]),
+		Mean: ms(sum / time.Duration(len(lat))),
+		P50:  ms(percentile(lat, 50)),
+		P90:  ms(percentile(lat, 90)),
+		P99:  ms(percentile(lat, 99)),
+		P999: ms(percentile(lat, 99.9)),
+		Max:  ms(lat[len(lat)-1]),
+	}
+	return rep
+}
+
+// percentile returns the pth percentile of sorted, by the
+// nearest-rank method
+func percentile(sorted []time.Duration, pct float64) time.Duration {
+	rank := int(pct/100*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// write prints the report as text
+func (r *Report) write(w io.Writer) {
+	fmt.Fprintf(w, "%s %q over %d conns, payload sizes %v\n", r.Addr, r.Req,
+		r.Conns, r.Sizes)
+	fmt.Fprintf(w, "requests:   %d in %.2fs (%.1f/s), %d errors\n",
+		r.Requests, r.Seconds, r.Throughput, r.Errors)
+	fmt.Fprintf(w, "bytes:      %d out, %d in\n", r.BytesOut, r.BytesIn)
+	l := r.Latency
+	fmt.Fprintf(w, "latency ms: min %.3f  mean %.3f  p50 %.3f  p90 %.3f  p99 %.3f  p99.9 %.3f  max %.3f\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	fmt.Fprintln(w, "statuses:")
+	for _, code := range sortedKeys(r.Statuses) {
+		txt := "app defined code"
+		if code <= 1024 && p.Stats[code] != nil {
+			txt = p.Stats[code].Txt
+		}
+		fmt.Fprintf(w, "  %d %-24s %d\n", code, txt, r.Statuses[code])
+	}
+	if len(r.ErrorTexts) > 0 {
+		fmt.Fprintln(w, "errors:")
+		for _, txt := range sortedKeys(r.ErrorTexts) {
+			fmt.Fprintf(w, "  %6d %s\n", r.ErrorTexts[txt], txt)
+		}
+	}
+}
+
+// sortedKeys returns the keys of m, in order
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	ps "github.com/firepear/petrel/server"
+)
+
+func TestPercentile(t *testing.T) {
+	var lat []time.Duration
+	for i := 1; i <= 100; i++ {
+		lat = append(lat, time.Duration(i))
+	}
+	for pct, want := range map[float64]time.Duration{50: 50, 90: 90, 99: 99,
+		99.9: 100, 100: 100, 0: 1} {
+		if got := percentile(lat, pct); got != want {
+			t.Errorf("%s: p%v: expected %d, got %d", t.Name(), pct, want, got)
+		}
+	}
+}
+
+func TestBenchEcho(t *testing.T) {
+	t.Setenv("TEST_BENCH_KEY", "sekrit")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-echo", "-conns", "4", "-n", "200", "-size", "16,1024",
+		"-hmac-env", "TEST_BENCH_KEY", "-json"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("%s: exit %d: %s", t.Name(), code, stderr.String())
+	}
+	var rep Report
+	if err := json.Unmarshal(stdout.Bytes(), &rep); err != nil {
+		t.Fatalf("%s: bad report: %s", t.Name(), err)
+	}
+	if rep.Requests != 200 || rep.Errors != 0 || rep.Statuses[200] != 200 {
+		t.Errorf("%s: bad counts: %+v", t.Name(), rep)
+	}
+	if rep.BytesIn != rep.BytesOut || rep.BytesOut != 100*16+100*1024 {
+		t.Errorf("%s: bad byte counts: %d %d", t.Name(), rep.BytesOut, rep.BytesIn)
+	}
+	if rep.Latency.Max < rep.Latency.P50 || rep.Latency.P50 <= 0 {
+		t.Errorf("%s: bad latency: %+v", t.Name(), rep.Latency)
+	}
+
+	// a paced run, with a text report
+	stdout.Reset()
+	code = run([]string{"-echo", "-conns", "2", "-duration", "200ms", "-rate", "50"},
+		&stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("%s: exit %d: %s", t.Name(), code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "200 reply sent") {
+		t.Errorf("%s: bad report:\n%s", t.Name(), stdout.String())
+	}
+}
+
+func TestBenchTimeout(t *testing.T) {
+	// a server which never answers
+	s, err := ps.New(&ps.Config{Addr: "localhost:60609"})
+	if err != nil {
+		t.Fatalf("%s: couldn't start server: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.RegisterCtx("stall", func(ctx context.Context, _ *ps.Request) (uint16, []byte, error) {
+		<-ctx.Done()
+		return 200, nil, nil
+	})
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	code := run([]string{"-addr", "localhost:60609", "-req", "stall", "-conns", "2",
+		"-n", "4", "-timeout", "50ms", "-json"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("%s: exit %d: %s", t.Name(), code, stderr.String())
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("%s: took %s, timeout not applied", t.Name(), d)
+	}
+	var rep Report
+	if err := json.Unmarshal(stdout.Bytes(), &rep); err != nil {
+		t.Fatalf("%s: bad report: %s", t.Name(), err)
+	}
+	if rep.Errors != 4 || len(rep.Statuses) != 0 {
+		t.Errorf("%s: expected 4 errors: %+v", t.Name(), rep)
+	}
+}
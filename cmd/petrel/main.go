@@ -0,0 +1,292 @@
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Command petrel makes requests of petrel servers from the shell.
+//
+//	petrel call [flags] ADDR NAME [PAYLOAD | @FILE | -]
+//
+// The payload is given literally, read from a file (@FILE), or read
+// from stdin (-). If it is omitted, the request has no payload.
+//
+// The response status is printed to stderr, and the payload to
+// stdout, so that it can be piped elsewhere. The exit code says how
+// the request went:
+//
+//	0  status below 300
+//	1  the request could not be made
+//	2  bad usage
+//	3  status 300-399
+//	4  status 400-499
+//	5  status 500-599
+//	6  application-defined status (over 1024)
+//	7  any other status (600-1024)
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	p "github.com/firepear/petrel"
+	pc "github.com/firepear/petrel/client"
+)
+
+// exit codes, other than those mapped from statuses
+const (
+	exitOK    = 0
+	exitFail  = 1
+	exitUsage = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run is main, minus the process. It returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+	switch args[0] {
+	case "call":
+		return call(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "petrel: unknown command %q\n", args[0])
+	usage(stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: petrel call [flags] ADDR NAME [PAYLOAD | @FILE | -]")
+	fmt.Fprintln(w, "run 'petrel call -h' for flags")
+}
+
+// callOpts holds the flags of the call command
+type callOpts struct {
+	network  string
+	timeout  time.Duration
+	format   string
+	tls      bool
+	ca       string
+	cert     string
+	key      string
+	insecure bool
+	sname    string
+	hmacEnv  string
+	hmacFile string
+	token    string
+	xferlim  uint
+	compress string
+}
+
+// call implements the call command
+func call(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var o callOpts
+	fs := flag.NewFlagSet("call", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: petrel call [flags] ADDR NAME [PAYLOAD | @FILE | -]")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.network, "network", "tcp", "network type: tcp or unix")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "request timeout (0 for none)")
+	fs.StringVar(&o.format, "format", "raw", "payload output format: raw, hex, or json")
+	fs.BoolVar(&o.tls, "tls", false, "connect with TLS (implied by -ca, -cert, and -insecure)")
+	fs.StringVar(&o.ca, "ca", "", "PEM file of CA certificates to verify the server with")
+	fs.StringVar(&o.cert, "cert", "", "PEM client certificate file")
+	fs.StringVar(&o.key, "key", "", "PEM client key file (default: same as -cert)")
+	fs.BoolVar(&o.insecure, "insecure", false, "don't verify the server's certificate")
+	fs.StringVar(&o.sname, "servername", "", "server name to verify the certificate against")
+	fs.StringVar(&o.hmacEnv, "hmac-env", "", "name of an environment variable holding the HMAC key")
+	fs.StringVar(&o.hmacFile, "hmac-file", "", "file holding the HMAC key")
+	fs.StringVar(&o.token, "token", "", "token to send as credentials")
+	fs.UintVar(&o.xferlim, "xferlim", 0, "maximum response payload size (0 for no limit)")
+	fs.StringVar(&o.compress, "compress", "", "comma-separated compressors to offer (e.g. gzip,flate)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		return exitUsage
+	}
+	if o.format != "raw" && o.format != "hex" && o.format != "json" {
+		fmt.Fprintf(stderr, "petrel: unknown format %q\n", o.format)
+		return exitUsage
+	}
+
+	addr, name := fs.Arg(0), fs.Arg(1)
+	var payload []byte
+	if fs.NArg() == 3 {
+		var err error
+		if payload, err = readPayload(fs.Arg(2), stdin); err != nil {
+			fmt.Fprintf(stderr, "petrel: %s\n", err)
+			return exitFail
+		}
+	}
+	conf, err := o.config(addr)
+	if err != nil {
+		fmt.Fprintf(stderr, "petrel: %s\n", err)
+		return exitFail
+	}
+
+	c, err := pc.New(conf)
+	if err != nil {
+		fmt.Fprintf(stderr, "petrel: couldn't connect to %s: %s\n", addr, err)
+		// handshake failures carry a status
+		var status uint16
+		if _, serr := fmt.Sscanf(err.Error(), "[%d]", &status); serr == nil {
+			return exitCode(status)
+		}
+		return exitFail
+	}
+	defer func() { _ = c.Quit() }()
+
+	err = c.Dispatch(name, payload)
+	if err != nil && c.Resp.Status == 0 {
+		fmt.Fprintf(stderr, "petrel: request failed: %s\n", err)
+		return exitFail
+	}
+	fmt.Fprintln(stderr, statusLine(c.Resp.Status))
+	if err != nil {
+		fmt.Fprintf(stderr, "petrel: %s\n", err)
+	}
+	if err = writePayload(stdout, c.Resp.Payload, o.format); err != nil {
+		fmt.Fprintf(stderr, "petrel: %s\n", err)
+	}
+	return exitCode(c.Resp.Status)
+}
+
+// config builds a client Config from the command's flags
+func (o *callOpts) config(addr string) (*pc.Config, error) {
+	conf := &pc.Config{Addr: addr, Network: o.network,
+		Timeout: o.timeout.Milliseconds(), Xferlim: uint32(o.xferlim)}
+	if o.compress != "" {
+		conf.Compress = strings.Split(o.compress, ",")
+	}
+	if o.token != "" {
+		conf.Credentials = &p.Credentials{Token: o.token}
+	}
+
+	switch {
+	case o.hmacEnv != "" && o.hmacFile != "":
+		return nil, fmt.Errorf("-hmac-env and -hmac-file are exclusive")
+	case o.hmacEnv != "":
+		key, ok := os.LookupEnv(o.hmacEnv)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("HMAC key variable %s is not set", o.hmacEnv)
+		}
+		conf.HMACKey = []byte(key)
+	case o.hmacFile != "":
+		key, err := os.ReadFile(o.hmacFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read HMAC key: %w", err)
+		}
+		// a trailing newline is almost certainly not part of
+		// the key
+		conf.HMACKey = bytes.TrimRight(key, "\r\n")
+	}
+
+	if !o.tls && o.ca == "" && o.cert == "" && !o.insecure {
+		return conf, nil
+	}
+	tc := &tls.Config{InsecureSkipVerify: o.insecure, ServerName: o.sname}
+	if o.ca != "" {
+		pem, err := os.ReadFile(o.ca)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA file: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.ca)
+		}
+	}
+	if o.cert != "" {
+		key := o.key
+		if key == "" {
+			key = o.cert
+		}
+		cert, err := tls.LoadX509KeyPair(o.cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	conf.TLS = tc
+	return conf, nil
+}
+
+// readPayload returns the payload named by arg: the contents of a
+// file for @FILE, stdin for -, and arg itself otherwise
+func readPayload(arg string, stdin io.Reader) ([]byte, error) {
+	switch {
+	case arg == "-":
+		return io.ReadAll(stdin)
+	case strings.HasPrefix(arg, "@"):
+		return os.ReadFile(arg[1:])
+	}
+	return []byte(arg), nil
+}
+
+// writePayload writes a response payload in the given format
+func writePayload(w io.Writer, payload []byte, format string) error {
+	var err error
+	switch format {
+	case "hex":
+		_, err = io.WriteString(w, hex.Dump(payload))
+	case "json":
+		if len(payload) == 0 {
+			return nil
+		}
+		var buf bytes.Buffer
+		if jerr := json.Indent(&buf, payload, "", "  "); jerr != nil {
+			// show what we got anyway
+			_, _ = w.Write(payload)
+			return fmt.Errorf("payload is not JSON: %w", jerr)
+		}
+		buf.WriteByte('\n')
+		_, err = buf.WriteTo(w)
+	default:
+		_, err = w.Write(payload)
+	}
+	return err
+}
+
+// statusLine describes a status, with its text from petrel.Stats
+func statusLine(status uint16) string {
+	if st, ok := p.Stats[status]; ok && status <= 1024 {
+		return fmt.Sprintf("%d %s", status, st.Txt)
+	}
+	return fmt.Sprintf("%d app defined code", status)
+}
+
+// exitCode maps a response status to an exit code. None of them is
+// exitFail or exitUsage, so that a script can tell what the server
+// said from what went wrong locally.
+func exitCode(status uint16) int {
+	switch {
+	case status > 1024:
+		return 6
+	case status < 300:
+		return exitOK
+	case status < 600:
+		return int(status / 100)
+	}
+	return 7
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ps "github.com/firepear/petrel/server"
+)
+
+var sn = "localhost:60606"
+
+func TestExitCode(t *testing.T) {
+	for status, code := range map[uint16]int{200: 0, 197: 0, 400: 4, 429: 4,
+		500: 5, 502: 5, 600: 7, 1024: 7, 2048: 6} {
+		if exitCode(status) != code {
+			t.Errorf("%s: %d: expected %d, got %d", t.Name(), status, code,
+				exitCode(status))
+		}
+	}
+}
+
+func TestReadPayload(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "payload")
+	_ = os.WriteFile(fn, []byte("from file"), 0600)
+	for arg, want := range map[string]string{"literal": "literal",
+		"@" + fn: "from file", "-": "from stdin"} {
+		pl, err := readPayload(arg, strings.NewReader("from stdin"))
+		if err != nil || string(pl) != want {
+			t.Errorf("%s: %s: got %q, %v", t.Name(), arg, pl, err)
+		}
+	}
+	if _, err := readPayload("@/nonexistent/file", nil); err == nil {
+		t.Errorf("%s: reading a missing file should fail", t.Name())
+	}
+}
+
+func TestCall(t *testing.T) {
+	s, err := ps.New(&ps.Config{Addr: sn, HMACKey: []byte("sekrit")})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("echo", func(pl []byte) (uint16, []byte, error) {
+		return 200, pl, nil
+	})
+	t.Setenv("TEST_PETREL_KEY", "sekrit")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"call", "-hmac-env", "TEST_PETREL_KEY", "-format", "json",
+		sn, "echo", "-"}, strings.NewReader(`{"a":1}`), &stdout, &stderr)
+	if code != 0 {
+		t.Errorf("%s: exit %d: %s", t.Name(), code, stderr.String())
+	}
+	if stdout.String() != "{\n  \"a\": 1\n}\n" {
+		t.Errorf("%s: bad output %q", t.Name(), stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "200 reply sent") {
+		t.Errorf("%s: bad status line %q", t.Name(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	code = run([]string{"call", "-hmac-env", "TEST_PETREL_KEY", sn, "nope"},
+		nil, &stdout, &stderr)
+	if code != 4 || !strings.Contains(stderr.String(), "400 handler not found") {
+		t.Errorf("%s: expected exit 4, got %d: %s", t.Name(), code, stderr.String())
+	}
+
+	if code = run([]string{"call", sn}, nil, &stdout, &stderr); code != exitUsage {
+		t.Errorf("%s: expected usage exit, got %d", t.Name(), code)
+	}
+	if code = run([]string{"call", "-hmac-env", "TEST_PETREL_NOPE", sn, "echo"},
+		nil, &stdout, &stderr); code != exitFail {
+		t.Errorf("%s: expected failure exit, got %d", t.Name(), code)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+package petrel
+
+// Payload encoding, for typed handlers and calls
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec encodes and decodes the payloads of typed requests and
+// responses (see server.RegisterTyped and client.DispatchTyped). A
+// server and its clients must use the same Codec.
+type Codec interface {
+	// Name is the name of the Codec, for use in messages
+	Name() string
+	// Marshal encodes v
+	Marshal(v any) ([]byte, error)
+	// Unmarshal decodes data into v, which is a pointer
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSONCodec encodes payloads with encoding/json. It is the
+	// default Codec.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes payloads with encoding/gob. Each payload
+	// is a complete gob stream, so types are described in every
+	// message.
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
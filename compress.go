@@ -0,0 +1,172 @@
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+package petrel
+
+// Payload compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultCompressMin is the payload size, in bytes, below which
+// payloads are sent uncompressed if no other threshold is given.
+const DefaultCompressMin = 1024
+
+// Compressor is a payload compression scheme. Compressors are
+// registered by name with RegisterCompressor, and clients and servers
+// agree on one during the PROTOCHECK handshake.
+type Compressor interface {
+	// Name is the name the Compressor is registered and
+	// negotiated under
+	Name() string
+	// NewWriter returns a WriteCloser which compresses what is
+	// written to it into w. Output is complete once it is
+	// closed.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a ReadCloser which decompresses r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	compMu      sync.RWMutex
+	compressors = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(gzipComp{})
+	RegisterCompressor(flateComp{})
+}
+
+// RegisterCompressor makes a Compressor available for negotiation,
+// under its Name. "gzip" and "flate" are registered by
+// default. Registering a Compressor under a name which is already in
+// use replaces the old one.
+func RegisterCompressor(c Compressor) {
+	compMu.Lock()
+	defer compMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// GetCompressor returns the Compressor registered under name, or nil
+// if there is none.
+func GetCompressor(name string) Compressor {
+	compMu.RLock()
+	defer compMu.RUnlock()
+	return compressors[name]
+}
+
+// gzipComp is the "gzip" Compressor
+type gzipComp struct{}
+
+func (gzipComp) Name() string { return "gzip" }
+
+func (gzipComp) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipComp) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// flateComp is the "flate" Compressor
+type flateComp struct{}
+
+func (flateComp) Name() string { return "flate" }
+
+func (flateComp) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateComp) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// compression is the compression in use on a Conn
+type compression struct {
+	comp Compressor
+	min  int
+}
+
+// SetCompression sets the Compressor used on the connection.
+// Payloads of at least min bytes are compressed when they are sent,
+// and payloads which arrive with FlagCompressed set are decompressed
+// with comp. A nil comp turns compression off. It is safe to call
+// while the Conn is in use.
+func (c *Conn) SetCompression(comp Compressor, min int) {
+	if comp == nil {
+		c.comp.Store(nil)
+		return
+	}
+	c.comp.Store(&compression{comp: comp, min: min})
+}
+
+// Compression returns the name of the Compressor in use on the
+// connection, or "" if there is none.
+func (c *Conn) Compression() string {
+	if cp := c.comp.Load(); cp != nil {
+		return cp.comp.Name()
+	}
+	return ""
+}
+
+// compress returns payload compressed, if the connection has a
+// Compressor, payload is big enough, and compressing it actually
+// makes it smaller. Otherwise it returns payload as-is, and false.
+func (c *Conn) compress(payload []byte) ([]byte, bool) {
+	cp := c.comp.Load()
+	if cp == nil || len(payload) == 0 || len(payload) < cp.min {
+		return payload, false
+	}
+	var buf bytes.Buffer
+	w, err := cp.comp.NewWriter(&buf)
+	if err != nil {
+		return payload, false
+	}
+	if _, err = w.Write(payload); err != nil {
+		return payload, false
+	}
+	if err = w.Close(); err != nil || buf.Len() >= len(payload) {
+		return payload, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompress decompresses a payload which arrived with
+// FlagCompressed set. The decompressed size is subject to c.Plim.
+func (c *Conn) decompress(payload []byte) ([]byte, error) {
+	cp := c.comp.Load()
+	if cp == nil {
+		c.Resp.Status = 415
+		return nil, fmt.Errorf("%s: no compression negotiated", Stats[415].Txt)
+	}
+	r, err := cp.comp.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		c.Resp.Status = 415
+		return nil, fmt.Errorf("%s: %w", Stats[415].Txt, err)
+	}
+	defer r.Close()
+	var lr io.Reader = r
+	if c.Plim != 0 {
+		// read one byte past the limit, to tell whether it
+		// was exceeded
+		lr = io.LimitReader(r, int64(c.Plim)+1)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, lr)
+	if err != nil {
+		c.Resp.Status = 415
+		return nil, fmt.Errorf("%s: %w", Stats[415].Txt, err)
+	}
+	if c.Plim != 0 && n > int64(c.Plim) {
+		c.Resp.Status = 402
+		return nil, fmt.Errorf("decompressed payload > %d", c.Plim)
+	}
+	return buf.Bytes(), nil
+}
@@ -5,21 +5,30 @@
 package petrel
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Resp is a packaged response, received from a Conn
 type Resp struct {
 	Status  uint16
+	Seq     uint32
+	Flags   uint8
 	Req     string
 	Payload []byte
+	// Trace is the trace context sent with the transmission; it
+	// is zero if there was none
+	Trace Trace
 }
 
 // Conn is a network connection plus associated per-connection data.
@@ -40,145 +49,187 @@ type Conn struct {
 	Resp Resp
 	// Payload length limit
 	Plim uint32
-	// Network timeout
+	// Network timeout. This is the default for any of the
+	// timeouts below which are zero
 	Timeout time.Duration
+	// IdleTimeout is how long to wait for a transmission to begin
+	IdleTimeout time.Duration
+	// HeaderTimeout is how long to wait for the rest of the
+	// header, and the request name, once a transmission has begun
+	HeaderTimeout time.Duration
+	// PayloadTimeout is how long to wait for the payload (and
+	// MAC) once the header has been read
+	PayloadTimeout time.Duration
+	// MinRate, if set, is the slowest rate in bytes per second at
+	// which a payload may arrive. The time allowed for a payload
+	// is PayloadTimeout (or one second, if there is no
+	// PayloadTimeout) plus the time it would take to receive it
+	// at MinRate.
+	MinRate uint32
+	// WriteTimeout is how long to wait for a transmission to be
+	// sent
+	WriteTimeout time.Duration
 	// HMAC key
 	Hkey []byte
 	// Msg channel
 	Msgr chan *Msg
+	// Ident is the identity the connection has authenticated as;
+	// nil if it has not. ignored for clients
+	Ident *Identity
+	// write lock; serializes transmissions from concurrent senders
+	wl sync.Mutex
+	// a read deadline is set
+	rd bool
+	// negotiated compression; nil if there is none
+	comp atomic.Pointer[compression]
+}
+
+// timeout returns d, or c.Timeout if d is zero
+func (c *Conn) timeout(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return c.Timeout
+}
+
+// readDeadline sets the read deadline for the next phase of a read,
+// d from now. If d is zero, any deadline left from a previous phase
+// is cleared.
+func (c *Conn) readDeadline(d time.Duration) error {
+	if d > 0 {
+		c.rd = true
+		return c.NC.SetReadDeadline(time.Now().Add(d))
+	}
+	if c.rd {
+		c.rd = false
+		return c.NC.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// payloadTimeout returns the time allowed to read a payload of plen
+// bytes
+func (c *Conn) payloadTimeout(plen uint32) time.Duration {
+	d := c.timeout(c.PayloadTimeout)
+	if c.MinRate == 0 {
+		return d
+	}
+	if d == 0 {
+		d = time.Second
+	}
+	return d + time.Duration(float64(plen)/float64(c.MinRate)*float64(time.Second))
+}
+
+// readErr sets the status for a failed read, and returns the error
+// to be reported. tstatus is the status for a timeout during the
+// current phase of the read.
+func (c *Conn) readErr(err error, tstatus uint16, what string) error {
+	var ne net.Error
+	switch {
+	case err == io.EOF:
+		c.Resp.Status = 198 // (probably) clean disconnect
+		return err
+	case errors.As(err, &ne) && ne.Timeout():
+		c.Resp.Status = tstatus
+		return fmt.Errorf("%s: %s: %w", Stats[tstatus].Txt, what, err)
+	}
+	c.Resp.Status = 498 // read err
+	return fmt.Errorf("%s: %s: %w", Stats[498].Txt, what, err)
 }
 
 // ConnRead reads a transmission from a connection.
 func ConnRead(c *Conn) error {
-	if cap(c.hb) != 11 {
-		c.hb = make([]byte, 11)
+	if cap(c.hb) != 12 {
+		c.hb = make([]byte, 12)
 	}
-	if c.Timeout > 0 {
-		err := c.NC.SetReadDeadline(time.Now().Add(c.Timeout))
-		if err != nil {
-			c.Resp.Status = 498
-			return err
-		}
+	// wait for the transmission to begin
+	if err := c.readDeadline(c.timeout(c.IdleTimeout)); err != nil {
+		c.Resp.Status = 498
+		return err
 	}
-	// read the transmission header
-	n, err := c.NC.Read(c.hb)
-	if err != nil {
+	if _, err := io.ReadFull(c.NC, c.hb[:1]); err != nil {
+		return c.readErr(err, 490, "no xmission header")
+	}
+
+	// read the rest of the transmission header
+	if err := c.readDeadline(c.timeout(c.HeaderTimeout)); err != nil {
+		c.Resp.Status = 498
+		return err
+	}
+	if _, err := io.ReadFull(c.NC, c.hb[1:]); err != nil {
 		if err == io.EOF {
-			c.Resp.Status = 198 // (probably) clean disconnect
-			return err
+			err = io.ErrUnexpectedEOF
 		}
-		c.Resp.Status = 498 // read err
-		return fmt.Errorf("%s: no xmission header: %v", Stats[498].Txt, err)
-	}
-	if n != cap(c.hb) {
-		c.Resp.Status = 498 // read errbinary.LittleEndian.Uint16(c.hb[0:1])
-		return fmt.Errorf("%s: short read on xmission header", Stats[498].Txt)
+		return c.readErr(err, 491, "short read on xmission header")
 	}
 
 	// get data from header, beginning with status
 	c.Resp.Status = binary.LittleEndian.Uint16(c.hb[0:2])
 	// sequence id
 	c.Seq = binary.LittleEndian.Uint32(c.hb[2:6])
+	c.Resp.Seq = c.Seq
+	// flags
+	c.Resp.Flags = c.hb[6]
 	// request length
-	rlen := uint8(c.hb[6])
+	rlen := uint8(c.hb[7])
 	// payload length
-	plen := binary.LittleEndian.Uint32(c.hb[7:])
+	plen := binary.LittleEndian.Uint32(c.hb[8:])
 
 	// read and decode the request. we do this before erroring if
 	// plen is over limit, so that Req will be set properly in
 	// logging and the reply
 	req := make([]byte, rlen)
-	n, err = c.NC.Read(req)
-	if err != nil {
-		if err == io.EOF {
-			c.Resp.Status = 198 // (probably) clean disconnect
-			return err
-		}
-		c.Resp.Status = 498 // read err
-		return fmt.Errorf("%s: couldn't read request: %v", Stats[498].Txt, err)
-	}
-	if uint8(n) != rlen {
-		c.Resp.Status = 498 // read err
-		return fmt.Errorf("%s: short read on request; expected %d bytes got %d",
-			Stats[498].Txt, rlen, n)
+	if _, err := io.ReadFull(c.NC, req); err != nil {
+		return c.readErr(err, 491, "couldn't read request")
 	}
 	c.Resp.Req = string(req)
 
+	// read the trace context, if there is one
+	c.Resp.Trace = Trace{}
+	if c.Resp.Flags&FlagTrace != 0 {
+		tb := make([]byte, 24)
+		if _, err := io.ReadFull(c.NC, tb); err != nil {
+			return c.readErr(err, 491, "couldn't read trace")
+		}
+		copy(c.Resp.Trace.ID[:], tb[:16])
+		copy(c.Resp.Trace.Span[:], tb[16:])
+	}
+
 	// reject the request if plen exceeds xfer limit
 	if c.Plim != 0 && plen > c.Plim {
 		c.Resp.Status = 402 // declared payload over lemgth limit
 		return fmt.Errorf("%d > %d", plen, c.Plim)
 	}
 
-	// setup to read payload
-	// network read buffer
-	b1 := make([]byte, 128)
-	// transmission accumulation buffer
-	b2 := []byte{}
-	// accumulated bytes read
-	bread := uint32(0)
-
-	// now read the payload
-	for bread < plen {
-		// if there are less than 128 bytes remaining to read
-		// in the payload, resize b1 to fit. this avoids
-		// reading across a transmission boundary.
-		if x := plen - bread; x < 128 {
-			b1 = make([]byte, x)
-		}
-		if c.Timeout > 0 {
-			err = c.NC.SetReadDeadline(time.Now().Add(c.Timeout))
-			if err != nil {
-				c.Resp.Status = 498
-				return err
-			}
-		}
-		n, err = c.NC.Read(b1)
-		if err != nil {
-			if err == io.EOF {
-				c.Resp.Status = 198
-				return err
-			}
-			c.Resp.Status = 498 // read err
+	// now read the payload. the buffer grows as data arrives,
+	// rather than trusting plen up front
+	if err := c.readDeadline(c.payloadTimeout(plen)); err != nil {
+		c.Resp.Status = 498
+		return err
+	}
+	pb := bytes.NewBuffer(make([]byte, 0, min(plen, 65536)))
+	if _, err := io.CopyN(pb, c.NC, int64(plen)); err != nil {
+		if err == io.EOF {
+			c.Resp.Status = 198
 			return err
 		}
-		bread += uint32(n)
-		if c.Plim > 0 && bread > c.Plim {
-			c.Resp.Status = 402 // (actual) payload over length limit
-			return fmt.Errorf("%d bytes", bread)
-		}
-		// it's easier to append everything, every time.
-		// overrun is handled as soon as we stop reading
-		b2 = append(b2, b1...)
+		return c.readErr(err, 492, "couldn't read payload")
 	}
-	// truncate payload accumulator at payload length and store as
-	// the response payload
-	c.Resp.Payload = b2[:plen]
+	c.Resp.Payload = pb.Bytes()
 
 	// finally, if we have a MAC, read and verify it
 	if c.Hkey != nil {
-		if c.Timeout > 0 {
-			err = c.NC.SetReadDeadline(time.Now().Add(c.Timeout))
-			if err != nil {
-				c.Resp.Status = 498
-				return err
-			}
+		if cap(c.pmac) != 44 {
+			c.pmac = make([]byte, 44)
 		}
-		n, err = c.NC.Read(c.pmac)
-		if err != nil {
+		if _, err := io.ReadFull(c.NC, c.pmac); err != nil {
 			if err == io.EOF {
-				c.Resp.Status = 198 // (probably) clean disconnect
-				return err
+				err = io.ErrUnexpectedEOF
 			}
-			c.Resp.Status = 498 // read err
-			return err
-		}
-		if n != 44 {
-			c.Resp.Status = 498 // read err
-			return fmt.Errorf("bad read on HMAC: %db != 44", n)
+			return c.readErr(err, 492, "bad read on HMAC")
 		}
 		mac := hmac.New(sha256.New, c.Hkey)
-		mac.Write(b2)
+		mac.Write(c.Resp.Payload)
 		computedMAC := make([]byte, 44)
 		base64.StdEncoding.Encode(computedMAC, mac.Sum(nil))
 		if !hmac.Equal(c.pmac, computedMAC) {
@@ -186,41 +237,86 @@ func ConnRead(c *Conn) error {
 			return fmt.Errorf("%v", Stats[502])
 		}
 	}
-	return err
-}
 
-// ConnWrite writes a message to a connection.
-func ConnWrite(c *Conn, request, payload []byte) error {
-	if c.Timeout > 0 {
-		err := c.NC.SetReadDeadline(time.Now().Add(c.Timeout))
+	// decompress the payload, if it was compressed. the MAC
+	// covers the payload as sent, so that is checked first
+	if c.Resp.Flags&FlagCompressed != 0 {
+		pl, err := c.decompress(c.Resp.Payload)
 		if err != nil {
-			c.Resp.Status = 498
 			return err
 		}
+		c.Resp.Payload = pl
 	}
+	return nil
+}
 
-	_, err := c.NC.Write(marshalXmission(c, request, payload))
+// ConnWrite writes a message to a connection, using the status
+// currently held in c.Resp and the sequence number in c.Seq.
+func ConnWrite(c *Conn, request, payload []byte) error {
+	err := ConnSend(c, &Resp{Status: c.Resp.Status, Seq: c.Seq,
+		Req: string(request), Payload: payload})
 	if err != nil {
 		// overloading response, but eh
-		c.Resp.Status = 499 // write error
+		c.Resp.Status = WriteStatus(err)
 	}
 	return err
 }
 
-// marshalXmission marshals a Msg payload into a wire-formatted
+// WriteStatus returns the status for an error from ConnSend or
+// ConnWrite: 493 if the write timed out, and 499 otherwise.
+func WriteStatus(err error) uint16 {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return 493
+	}
+	return 499
+}
+
+// ConnSend writes r to a connection as a single transmission. Unlike
+// ConnWrite, it takes status and sequence number from r rather than
+// from the Conn, so it is safe to call from multiple goroutines
+// sharing one Conn.
+func ConnSend(c *Conn, r *Resp) error {
+	xmission := marshalXmission(c, r)
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	if t := c.timeout(c.WriteTimeout); t > 0 {
+		err := c.NC.SetWriteDeadline(time.Now().Add(t))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := c.NC.Write(xmission)
+	return err
+}
+
+// marshalXmission marshals a Resp into a wire-formatted
 // transmission.
-func marshalXmission(c *Conn, request, payload []byte) []byte {
-	xmission := make([]byte, 11)
+func marshalXmission(c *Conn, r *Resp) []byte {
+	payload, compressed := c.compress(r.Payload)
+	xmission := make([]byte, 12)
 	// status
-	binary.LittleEndian.PutUint16(xmission[0:], c.Resp.Status)
+	binary.LittleEndian.PutUint16(xmission[0:], r.Status)
 	// seq
-	binary.LittleEndian.PutUint32(xmission[2:], c.Seq)
+	binary.LittleEndian.PutUint32(xmission[2:], r.Seq)
+	// flags
+	xmission[6] = r.Flags &^ (FlagTrace | FlagCompressed)
+	if !r.Trace.IsZero() {
+		xmission[6] |= FlagTrace
+	}
+	if compressed {
+		xmission[6] |= FlagCompressed
+	}
 	// encode request length
-	xmission[6] = uint8(len(request))
+	xmission[7] = uint8(len(r.Req))
 	// encode payload length
-	binary.LittleEndian.PutUint32(xmission[7:], uint32(len(payload)))
-	// append request and payload
-	xmission = append(xmission, request...)
+	binary.LittleEndian.PutUint32(xmission[8:], uint32(len(payload)))
+	// append request, trace, and payload
+	xmission = append(xmission, r.Req...)
+	if !r.Trace.IsZero() {
+		xmission = append(xmission, r.Trace.ID[:]...)
+		xmission = append(xmission, r.Trace.Span[:]...)
+	}
 	xmission = append(xmission, payload...)
 	// handle HMAC if needed
 	if c.Hkey != nil {
@@ -15,7 +15,61 @@ type Status struct {
 var (
 	// Proto is the version of the wire protocol implemented by
 	// this library
-	Proto = []byte{0}
+	Proto = []byte{1}
+)
+
+// Credentials are sent by a client as part of the PROTOCHECK
+// handshake, for a server's Authenticator to examine. Any or all of
+// the fields may be set; what they mean is up to the Authenticator.
+type Credentials struct {
+	Token string `json:"token,omitempty"`
+	User  string `json:"user,omitempty"`
+	Pass  string `json:"pass,omitempty"`
+	Blob  []byte `json:"blob,omitempty"`
+}
+
+// Hello is the body of a client's PROTOCHECK request, which follows
+// the protocol version byte. Its Credentials fields are inlined, so
+// that a Hello with no Compress list is the same, on the wire, as
+// bare Credentials.
+type Hello struct {
+	Credentials
+	// Compress lists the Compressors the client can use, in
+	// order of preference
+	Compress []string `json:"compress,omitempty"`
+}
+
+// Identity is who a connection has authenticated as. It is set during
+// the PROTOCHECK handshake, by a server's Authenticator or from a TLS
+// client certificate.
+type Identity struct {
+	// Name is the name of the authenticated entity
+	Name string
+	// Groups are any groups or roles the entity belongs to
+	Groups []string
+}
+
+// Transmission header flags. These are bits in the flags byte of the
+// wire protocol header, and are found in Resp.Flags.
+const (
+	// FlagStream marks a transmission as one chunk of a streamed
+	// response. More transmissions with the same Seq will follow.
+	FlagStream uint8 = 1 << iota
+	// FlagEOS marks the end of a streamed response. It carries
+	// the final status of the stream, and no payload.
+	FlagEOS
+	// FlagPush marks a transmission which was sent by a server
+	// on its own initiative, rather than in reply to a request.
+	// Its Seq is always zero.
+	FlagPush
+	// FlagTrace marks a transmission which carries a Trace. The
+	// trace context (16 bytes of TraceID and 8 of SpanID) follows
+	// the request name.
+	FlagTrace
+	// FlagCompressed marks a transmission whose payload has been
+	// compressed with the Compressor negotiated for the
+	// connection.
+	FlagCompressed
 )
 
 // Stats is the map of Status instances. It is used by Msg handling
@@ -30,6 +84,14 @@ var Stats = map[uint16]*Status{
 		"Debug",
 		"in dispatch",
 	},
+	102: {
+		"Debug",
+		"push sent",
+	},
+	197: {
+		"Info",
+		"server going away",
+	},
 	198: {
 		"Info",
 		"client disconnected",
@@ -54,6 +116,62 @@ var Stats = map[uint16]*Status{
 		"Error",
 		"payload length limit exceeded",
 	},
+	403: {
+		"Warn",
+		"forbidden",
+	},
+	404: {
+		"Warn",
+		"not found",
+	},
+	415: {
+		"Error",
+		"bad compressed payload",
+	},
+	422: {
+		"Warn",
+		"bad request",
+	},
+	429: {
+		"Warn",
+		"rate limited",
+	},
+	430: {
+		"Warn",
+		"too many requests in flight",
+	},
+	489: {
+		"Error",
+		"keepalive failed",
+	},
+	490: {
+		"Info",
+		"idle timeout",
+	},
+	491: {
+		"Error",
+		"header read timeout",
+	},
+	492: {
+		"Error",
+		"payload read timeout",
+	},
+	493: {
+		"Error",
+		"write timeout",
+	},
+	494: {
+		"Warn",
+		"request timeout",
+	},
+	495: {
+		"Warn",
+		"connection limit reached",
+	},
+	496: {
+		"Error",
+		"authentication failed",
+	},
 	497: {
 		"Error",
 		"protocol mismatch",
@@ -78,6 +196,10 @@ var Stats = map[uint16]*Status{
 		"Error",
 		"HMAC verification failed",
 	},
+	520: {
+		"Warn",
+		"method returned an error",
+	},
 	599: {
 		"Error",
 		"read from listener socket failed",
@@ -1,7 +1,10 @@
 package petrel
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -31,3 +34,73 @@ func TestMsgError(t *testing.T) {
 		t.Errorf("%s: mstr doesn't match: %s", t.Name(), mstr)
 	}
 }
+
+func TestTrace(t *testing.T) {
+	var zero Trace
+	if !zero.IsZero() {
+		t.Errorf("%s: zero Trace isn't zero", t.Name())
+	}
+	tr := NewTrace()
+	if tr.IsZero() || tr.ID == (TraceID{}) || tr.Span == (SpanID{}) {
+		t.Errorf("%s: NewTrace left fields zero: %+v", t.Name(), tr)
+	}
+	c := tr.Child()
+	if c.ID != tr.ID || c.Span == tr.Span {
+		t.Errorf("%s: bad child %+v of %+v", t.Name(), c, tr)
+	}
+	if len(tr.ID.String()) != 32 || len(tr.Span.String()) != 16 {
+		t.Errorf("%s: bad strings %s %s", t.Name(), tr.ID, tr.Span)
+	}
+	if _, ok := TraceFromContext(context.Background()); ok {
+		t.Errorf("%s: found a trace in an empty context", t.Name())
+	}
+	got, ok := TraceFromContext(ContextWithTrace(context.Background(), tr))
+	if !ok || got != tr {
+		t.Errorf("%s: context round trip failed: %+v", t.Name(), got)
+	}
+}
+
+// compressed payloads round trip, and Plim applies to their
+// decompressed size
+func TestCompression(t *testing.T) {
+	for _, name := range []string{"gzip", "flate"} {
+		a, b := net.Pipe()
+		ca := &Conn{NC: a}
+		cb := &Conn{NC: b, Plim: 2048}
+		comp := GetCompressor(name)
+		if comp == nil {
+			t.Fatalf("%s: %s not registered", t.Name(), name)
+		}
+		ca.SetCompression(comp, 64)
+		cb.SetCompression(comp, 64)
+		if ca.Compression() != name {
+			t.Errorf("%s: bad compression name %q", t.Name(), ca.Compression())
+		}
+
+		for _, pl := range [][]byte{[]byte("short"),
+			bytes.Repeat([]byte("abcd"), 500), bytes.Repeat([]byte("x"), 4096)} {
+			go func() { _ = ConnSend(ca, &Resp{Status: 200, Seq: 1, Req: "r", Payload: pl}) }()
+			err := ConnRead(cb)
+			compressed := cb.Resp.Flags&FlagCompressed != 0
+			switch {
+			case len(pl) < 64:
+				if err != nil || compressed || !bytes.Equal(cb.Resp.Payload, pl) {
+					t.Errorf("%s: %s: small payload: %v %v", t.Name(), name, err, compressed)
+				}
+			case len(pl) <= 2048:
+				if err != nil || !compressed || !bytes.Equal(cb.Resp.Payload, pl) {
+					t.Errorf("%s: %s: payload: %v %v", t.Name(), name, err, compressed)
+				}
+			default:
+				// small on the wire, but too big once
+				// decompressed
+				if err == nil || cb.Resp.Status != 402 {
+					t.Errorf("%s: %s: expected 402, got %d %v", t.Name(), name,
+						cb.Resp.Status, err)
+				}
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+}
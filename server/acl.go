@@ -0,0 +1,69 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Access control for handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"slices"
+
+	p "github.com/firepear/petrel"
+)
+
+// ACL is an access control list. A connection is permitted by an ACL
+// if its Identity's Name is in Names, or if any of its Groups are in
+// Groups. Connections with no Identity are never permitted.
+type ACL struct {
+	Names  []string
+	Groups []string
+}
+
+// Permits reports whether an ACL allows access to the given Identity.
+func (a ACL) Permits(ident *p.Identity) bool {
+	if ident == nil {
+		return false
+	}
+	if slices.Contains(a.Names, ident.Name) {
+		return true
+	}
+	for _, g := range ident.Groups {
+		if slices.Contains(a.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow returns a Middleware which enforces an ACL. Requests from
+// connections which the ACL does not permit are rejected with status
+// 403, and never reach the handler. To protect a single handler, pass
+// it to Register:
+//
+//	s.Register("reboot", reboot, server.Allow(server.ACL{Groups: []string{"admin"}}))
+func Allow(acl ACL) Middleware {
+	return func(next HandlerCtx) HandlerCtx {
+		return func(ctx context.Context, req *Request) (uint16, []byte, error) {
+			if !acl.Permits(req.Ident) {
+				return 403, nil, nil
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// tlsIdentity returns an Identity built from the client certificate
+// of a TLS connection: the certificate's Common Name becomes the
+// Name, and its Organizational Units become the Groups. It returns
+// nil if there is no client certificate.
+func tlsIdentity(cs *tls.ConnectionState) *p.Identity {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	subj := cs.PeerCertificates[0].Subject
+	return &p.Identity{Name: subj.CommonName,
+		Groups: append([]string{}, subj.OrganizationalUnit...)}
+}
@@ -0,0 +1,116 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements server-side handling of streamed request
+// bodies.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// bodyChunks is how many chunks of a request body may be queued for
+// a BodyHandler before the connection stops reading
+const bodyChunks = 4
+
+// BodyHandler is the type which functions passed to
+// Server.RegisterBody must match. It is for requests too big to hold
+// in memory: rather than a payload, it gets the request body as an
+// io.Reader, and like a StreamHandler it writes its response to w,
+// each Write being sent to the client as one chunk.
+//
+// Clients send bodies with client.DispatchBody, in chunks, each of
+// which is subject to Xferlim and HMAC verification as it
+// arrives. Body reads fail with io.ErrUnexpectedEOF if the connection
+// closes before the body is complete. A plain request to a
+// BodyHandler has its payload as its body.
+//
+// Chunks are queued for the handler only a few at a time, and while
+// the queue is full, no other requests are read from the
+// connection. A BodyHandler should therefore read its body promptly;
+// any part of the body it has not read when it returns is discarded.
+type BodyHandler func(ctx context.Context, r *Request, body io.Reader, w io.Writer) (uint16, error)
+
+// RegisterBody adds a BodyHandler function to a Server. Its arguments
+// are the same as those of Register.
+func (s *Server) RegisterBody(name string, r BodyHandler, mw ...Middleware) error {
+	return s.register(name, &handler{
+		fn: func(ctx context.Context, req *Request) (uint16, []byte, error) {
+			// if the body was not streamed, the payload
+			// is the body
+			var body io.Reader = bytes.NewReader(req.Payload)
+			if req.body != nil {
+				body = req.body
+			}
+			status, err := r(ctx, req, body, req.w)
+			return status, nil, err
+		},
+		mw:     mw,
+		stream: true,
+		body:   true})
+}
+
+// body is the io.Reader over a streamed request body. connServer
+// pushes chunks into it as they arrive.
+type body struct {
+	ch   chan []byte
+	cur  []byte
+	err  error         // why the body ended, if not io.EOF
+	done chan struct{} // closed when the handler stops reading
+	once sync.Once
+	n    atomic.Int64 // bytes received
+}
+
+func newBody() *body {
+	return &body{ch: make(chan []byte, bodyChunks), done: make(chan struct{})}
+}
+
+// Read implements io.Reader.
+func (b *body) Read(p []byte) (int, error) {
+	for len(b.cur) == 0 {
+		chunk, ok := <-b.ch
+		if !ok {
+			if b.err != nil {
+				return 0, b.err
+			}
+			return 0, io.EOF
+		}
+		b.cur = chunk
+	}
+	n := copy(p, b.cur)
+	b.cur = b.cur[n:]
+	return n, nil
+}
+
+// push queues a chunk for the handler, waiting for room. Chunks which
+// arrive after the handler has stopped reading are dropped.
+func (b *body) push(ctx context.Context, chunk []byte) {
+	b.n.Add(int64(len(chunk)))
+	if len(chunk) == 0 {
+		return
+	}
+	select {
+	case b.ch <- chunk:
+	case <-b.done:
+	case <-ctx.Done():
+	}
+}
+
+// end marks the end of the body. err is what reads return once the
+// queued chunks are used up; nil means io.EOF.
+func (b *body) end(err error) {
+	b.err = err
+	close(b.ch)
+}
+
+// stop is called when the handler returns, so that pushes no longer
+// wait for it
+func (b *body) stop() {
+	b.once.Do(func() { close(b.done) })
+}
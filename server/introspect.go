@@ -0,0 +1,158 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Introspection handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// HandlerInfo describes a handler, as listed by PETREL.HANDLERS.
+type HandlerInfo struct {
+	Name   string `json:"name"`
+	Desc   string `json:"desc,omitempty"`
+	Stream bool   `json:"stream,omitempty"`
+}
+
+// ServerInfo describes a Server, as returned by PETREL.INFO.
+type ServerInfo struct {
+	Sid     string    `json:"sid"`
+	Proto   int       `json:"proto"`
+	Started time.Time `json:"started"`
+	Uptime  string    `json:"uptime"`
+	Limits  Limits    `json:"limits"`
+}
+
+// Limits are the limits a Server enforces, as reported in
+// ServerInfo. Timeouts are in milliseconds, and zero means no
+// limit.
+type Limits struct {
+	Xferlim          uint32 `json:"xferlim"`
+	MaxConns         int    `json:"max_conns"`
+	MaxConnsPerIP    int    `json:"max_conns_per_ip"`
+	MaxConnsPerIdent int    `json:"max_conns_per_ident"`
+	ConnRate         Rate   `json:"conn_rate"`
+	IPRate           Rate   `json:"ip_rate"`
+	Timeout          int64  `json:"timeout"`
+	IdleTimeout      int64  `json:"idle_timeout"`
+	HeaderTimeout    int64  `json:"header_timeout"`
+	PayloadTimeout   int64  `json:"payload_timeout"`
+	WriteTimeout     int64  `json:"write_timeout"`
+	HandlerTimeout   int64  `json:"handler_timeout"`
+	MinRate          uint32 `json:"min_rate"`
+}
+
+// StatusInfo describes a status code, as listed by PETREL.STATUS.
+type StatusInfo struct {
+	Code  uint16 `json:"code"`
+	Level string `json:"level"`
+	Text  string `json:"text"`
+}
+
+// Describe sets the description of a handler, which is listed by
+// PETREL.HANDLERS. Like Register, it should be called before clients
+// begin sending requests.
+func (s *Server) Describe(name, desc string) error {
+	h, ok := s.d[name]
+	if !ok {
+		return fmt.Errorf("no such handler '%s'", name)
+	}
+	h.desc = desc
+	return nil
+}
+
+// Introspect registers the reserved handlers which let clients find
+// out about the Server. Each returns JSON:
+//
+//   - PETREL.HANDLERS lists the registered handlers, as HandlerInfo
+//   - PETREL.INFO describes the Server, as ServerInfo
+//   - PETREL.STATUS lists the status codes in petrel.Stats, as
+//     StatusInfo. Applications which add their own codes to Stats
+//     before starting the Server will see them listed too.
+//
+// They are not registered by default. 'mw' is optional Middleware
+// for all three, so that access to them can be restricted with
+// Allow.
+func (s *Server) Introspect(mw ...Middleware) error {
+	for name, fn := range map[string]Handler{
+		"PETREL.HANDLERS": s.handlersInfo,
+		"PETREL.INFO":     s.serverInfo,
+		"PETREL.STATUS":   statusInfo,
+	} {
+		if err := s.Register(name, fn, mw...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlersInfo implements PETREL.HANDLERS
+func (s *Server) handlersInfo(_ []byte) (uint16, []byte, error) {
+	hi := []HandlerInfo{}
+	for name, h := range s.d {
+		hi = append(hi, HandlerInfo{Name: name, Desc: h.desc, Stream: h.stream})
+	}
+	slices.SortFunc(hi, func(a, b HandlerInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return jsonResp(hi)
+}
+
+// serverInfo implements PETREL.INFO
+func (s *Server) serverInfo(_ []byte) (uint16, []byte, error) {
+	ms := func(d time.Duration) int64 { return d.Milliseconds() }
+	si := ServerInfo{
+		Sid:     s.sid,
+		Proto:   int(p.Proto[0]),
+		Started: s.st,
+		Uptime:  time.Since(s.st).Round(time.Second).String(),
+		Limits: Limits{
+			Xferlim:          s.rl,
+			MaxConns:         s.lim.max,
+			MaxConnsPerIP:    s.lim.maxip,
+			MaxConnsPerIdent: s.lim.maxid,
+			ConnRate:         s.cr,
+			Timeout:          ms(s.t),
+			IdleTimeout:      ms(s.ti),
+			HeaderTimeout:    ms(s.th),
+			PayloadTimeout:   ms(s.tp),
+			WriteTimeout:     ms(s.tw),
+			HandlerTimeout:   ms(s.tx),
+			MinRate:          s.mr,
+		},
+	}
+	if s.ipb != nil {
+		si.Limits.IPRate = s.ipb.rate
+	}
+	return jsonResp(si)
+}
+
+// statusInfo implements PETREL.STATUS
+func statusInfo(_ []byte) (uint16, []byte, error) {
+	si := []StatusInfo{}
+	for code, st := range p.Stats {
+		si = append(si, StatusInfo{Code: code, Level: st.Lvl, Text: st.Txt})
+	}
+	slices.SortFunc(si, func(a, b StatusInfo) int {
+		return int(a.Code) - int(b.Code)
+	})
+	return jsonResp(si)
+}
+
+// jsonResp encodes v as a handler response
+func jsonResp(v any) (uint16, []byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 500, nil, err
+	}
+	return 200, b, nil
+}
@@ -0,0 +1,200 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Connection limits
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// rejectWait is how long a connection which is over a limit has to
+// send its PROTOCHECK, so that it can be told why it is being
+// rejected
+const rejectWait = time.Second
+
+// maxRejects is the number of rejected connections which may be
+// waiting out rejectWait at once. Connections rejected beyond that
+// are closed immediately, so that a flood of them cannot tie up the
+// descriptors the limits are meant to protect.
+var maxRejects = 64
+
+// ConnCounts is a snapshot of the connections open on a Server, as
+// returned by Server.ConnCounts.
+type ConnCounts struct {
+	// Total is the number of open connections
+	Total int
+	// ByIP is the number of open connections from each remote IP
+	// address. Unix domain socket connections are not included.
+	ByIP map[string]int
+	// ByIdent is the number of open connections which have
+	// authenticated as each Identity Name
+	ByIdent map[string]int
+}
+
+// connLimits tracks open connections against a Server's limits
+type connLimits struct {
+	mu    sync.Mutex
+	max   int               // max total conns
+	maxip int               // max conns per ip
+	maxid int               // max conns per identity
+	total int               // open conns
+	rmax  int               // max rejected conns waiting
+	rej   int               // rejected conns waiting
+	ip    map[string]int    // open conns by ip
+	id    map[string]int    // open conns by identity
+	cid   map[string]string // identity of each counted conn, by conn id
+}
+
+func newConnLimits(c *Config) *connLimits {
+	return &connLimits{
+		max:   c.MaxConns,
+		maxip: c.MaxConnsPerIP,
+		maxid: c.MaxConnsPerIdent,
+		rmax:  maxRejects,
+		ip:    map[string]int{},
+		id:    map[string]int{},
+		cid:   map[string]string{},
+	}
+}
+
+// remoteIP returns the IP address of a TCP peer, or "" for anything
+// else
+func remoteIP(addr net.Addr) string {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	return ""
+}
+
+// admit counts a new connection, unless that would put the Server
+// over its total or per-IP limit. If it would, the connection is not
+// counted and the reason is returned.
+func (l *connLimits) admit(addr net.Addr) string {
+	ip := remoteIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return fmt.Sprintf("max conns (%d)", l.max)
+	}
+	if ip != "" && l.maxip > 0 && l.ip[ip] >= l.maxip {
+		return fmt.Sprintf("max conns per ip (%d) for %s", l.maxip, ip)
+	}
+	l.total++
+	if ip != "" {
+		l.ip[ip]++
+	}
+	return ""
+}
+
+// admitIdent counts a connection against the Identity it has
+// authenticated as, unless that would put the Identity over its
+// limit. If it would, the reason is returned.
+func (l *connLimits) admitIdent(c *p.Conn, ident *p.Identity) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseIdent(c)
+	if ident == nil {
+		return ""
+	}
+	if l.maxid > 0 && l.id[ident.Name] >= l.maxid {
+		return fmt.Sprintf("max conns per identity (%d) for %s",
+			l.maxid, ident.Name)
+	}
+	l.id[ident.Name]++
+	l.cid[c.Id] = ident.Name
+	return ""
+}
+
+// holdReject reports whether a rejected connection may wait for its
+// PROTOCHECK. If so, it is counted until dropReject is called.
+func (l *connLimits) holdReject() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rej >= l.rmax {
+		return false
+	}
+	l.rej++
+	return true
+}
+
+// dropReject uncounts a rejected connection which was waiting
+func (l *connLimits) dropReject() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rej--
+}
+
+// release uncounts a closed connection
+func (l *connLimits) release(c *p.Conn) {
+	ip := remoteIP(c.NC.RemoteAddr())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if ip != "" {
+		if l.ip[ip]--; l.ip[ip] == 0 {
+			delete(l.ip, ip)
+		}
+	}
+	l.releaseIdent(c)
+}
+
+// releaseIdent uncounts a connection's identity, if it was
+// counted. l.mu must be held.
+func (l *connLimits) releaseIdent(c *p.Conn) {
+	name, ok := l.cid[c.Id]
+	if !ok {
+		return
+	}
+	delete(l.cid, c.Id)
+	if l.id[name]--; l.id[name] == 0 {
+		delete(l.id, name)
+	}
+}
+
+// ConnCounts returns the number of connections currently open on the
+// Server, in total and broken down by remote IP and by identity.
+func (s *Server) ConnCounts() ConnCounts {
+	s.lim.mu.Lock()
+	defer s.lim.mu.Unlock()
+	return ConnCounts{
+		Total:   s.lim.total,
+		ByIP:    maps.Clone(s.lim.ip),
+		ByIdent: maps.Clone(s.lim.id),
+	}
+}
+
+// reject turns away a connection which is over a limit. If wait is
+// true, it waits briefly for the client's PROTOCHECK, so that the
+// refusal can be sent as its response. Either way, it then closes
+// the connection.
+func (s *Server) reject(c *p.Conn, why string, wait bool) {
+	defer s.w.Done()
+	defer func() { _ = c.NC.Close() }()
+	s.met.conn(false)
+	c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: "NONE", Code: 495,
+		Txt: fmt.Sprintf("%s: %s %s", p.Stats[495].Txt, why,
+			c.NC.RemoteAddr().String()),
+		Err: nil}
+	if !wait {
+		return
+	}
+	defer s.lim.dropReject()
+	// the per-phase timeouts would replace the deadline, leaving
+	// the conn open for as long as they allow, so they are cleared
+	c.Timeout, c.IdleTimeout, c.HeaderTimeout = 0, 0, 0
+	c.PayloadTimeout, c.WriteTimeout, c.MinRate = 0, 0, 0
+	_ = c.NC.SetDeadline(time.Now().Add(rejectWait))
+	if p.ConnRead(c) == nil {
+		_ = p.ConnSend(c, &p.Resp{Status: 495, Seq: c.Resp.Seq,
+			Req: c.Resp.Req, Payload: []byte(why)})
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Server metrics
+
+import (
+	"bufio"
+	"cmp"
+	"expvar"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets in
+// request latency histograms. A Server uses the buckets as they were
+// when it was created; later changes only affect new Servers.
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05,
+	.1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics is a snapshot of a Server's metrics, as returned by
+// Server.Metrics.
+type Metrics struct {
+	// Conns holds connection counts
+	Conns ConnMetrics
+	// Handlers holds request metrics for each handler, by name.
+	// Requests for names which have no handler are not
+	// included, but do count toward Statuses.
+	Handlers map[string]HandlerMetrics
+	// Statuses is the number of times each status has been
+	// logged, for requests and connections alike
+	Statuses map[uint16]uint64
+}
+
+// ConnMetrics holds a Server's connection counts.
+type ConnMetrics struct {
+	// Open is the number of connections currently open
+	Open int
+	// Accepted is the number of connections accepted
+	Accepted uint64
+	// Rejected is the number of connections refused for being
+	// over a connection limit
+	Rejected uint64
+}
+
+// HandlerMetrics holds the request metrics for one handler.
+type HandlerMetrics struct {
+	// Requests is the number of requests handled
+	Requests uint64
+	// Statuses is the number of responses with each status
+	Statuses map[uint16]uint64
+	// BytesIn is the total size of request payloads
+	BytesIn uint64
+	// BytesOut is the total size of response payloads,
+	// including stream chunks
+	BytesOut uint64
+	// Latency is the distribution of handling times
+	Latency Histogram
+}
+
+// Histogram is a latency histogram. Counts are cumulative: Counts[i]
+// is the number of observations less than or equal to Buckets[i].
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	// Count is the total number of observations
+	Count uint64
+	// Sum is the sum of all observations, in seconds
+	Sum float64
+}
+
+// metrics collects a Server's metrics
+type metrics struct {
+	mu       sync.Mutex
+	buckets  []float64
+	accepted uint64
+	rejected uint64
+	statuses map[uint16]uint64
+	handlers map[string]*handlerMetrics
+}
+
+// handlerMetrics collects the metrics for one handler. Its bucket
+// counts are not cumulative; that is done when a snapshot is made.
+type handlerMetrics struct {
+	requests uint64
+	statuses map[uint16]uint64
+	in       uint64
+	out      uint64
+	counts   []uint64
+	sum      float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		buckets:  slices.Clone(LatencyBuckets),
+		statuses: map[uint16]uint64{},
+		handlers: map[string]*handlerMetrics{},
+	}
+}
+
+// status counts a logged status
+func (m *metrics) status(code uint16) {
+	m.mu.Lock()
+	m.statuses[code]++
+	m.mu.Unlock()
+}
+
+// conn counts an accepted or rejected connection
+func (m *metrics) conn(accepted bool) {
+	m.mu.Lock()
+	if accepted {
+		m.accepted++
+	} else {
+		m.rejected++
+	}
+	m.mu.Unlock()
+}
+
+// request records a request handled by the named handler
+func (m *metrics) request(name string, status uint16, in, out int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hm, ok := m.handlers[name]
+	if !ok {
+		hm = &handlerMetrics{statuses: map[uint16]uint64{},
+			counts: make([]uint64, len(m.buckets)+1)}
+		m.handlers[name] = hm
+	}
+	hm.requests++
+	hm.statuses[status]++
+	hm.in += uint64(in)
+	hm.out += uint64(out)
+	secs := d.Seconds()
+	i, _ := slices.BinarySearch(m.buckets, secs)
+	hm.counts[i]++
+	hm.sum += secs
+}
+
+// Metrics returns a snapshot of the Server's metrics.
+func (s *Server) Metrics() Metrics {
+	m := Metrics{Conns: ConnMetrics{Open: s.ConnCounts().Total},
+		Handlers: map[string]HandlerMetrics{}}
+	s.met.mu.Lock()
+	defer s.met.mu.Unlock()
+	m.Conns.Accepted = s.met.accepted
+	m.Conns.Rejected = s.met.rejected
+	m.Statuses = maps.Clone(s.met.statuses)
+	for name, hm := range s.met.handlers {
+		h := HandlerMetrics{
+			Requests: hm.requests,
+			Statuses: maps.Clone(hm.statuses),
+			BytesIn:  hm.in,
+			BytesOut: hm.out,
+			Latency: Histogram{Buckets: slices.Clone(s.met.buckets),
+				Counts: make([]uint64, len(s.met.buckets)),
+				Count:  hm.requests, Sum: hm.sum},
+		}
+		var n uint64
+		for i := range s.met.buckets {
+			n += hm.counts[i]
+			h.Latency.Counts[i] = n
+		}
+		m.Handlers[name] = h
+	}
+	return m
+}
+
+// PublishExpvar publishes the Server's metrics with package expvar,
+// under the given name, so that they appear at /debug/vars. As with
+// expvar.Publish, it panics if the name is already in use.
+func (s *Server) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return s.Metrics() }))
+}
+
+// WritePrometheus writes the Server's metrics to w in the Prometheus
+// text exposition format. To serve them from a net/http mux:
+//
+//	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+//		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+//		s.WritePrometheus(w)
+//	})
+func (s *Server) WritePrometheus(w io.Writer) error {
+	m := s.Metrics()
+	bw := bufio.NewWriter(w)
+	names := sortedKeys(m.Handlers)
+	sid := "sid=" + promQuote(s.sid)
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	header("petrel_connections_open", "gauge", "Connections currently open.")
+	fmt.Fprintf(bw, "petrel_connections_open{%s} %d\n", sid, m.Conns.Open)
+	header("petrel_connections_accepted_total", "counter", "Connections accepted.")
+	fmt.Fprintf(bw, "petrel_connections_accepted_total{%s} %d\n", sid, m.Conns.Accepted)
+	header("petrel_connections_rejected_total", "counter",
+		"Connections refused for being over a limit.")
+	fmt.Fprintf(bw, "petrel_connections_rejected_total{%s} %d\n", sid, m.Conns.Rejected)
+
+	header("petrel_statuses_total", "counter", "Statuses logged, by code.")
+	for _, code := range sortedKeys(m.Statuses) {
+		fmt.Fprintf(bw, "petrel_statuses_total{%s,status=\"%d\"} %d\n",
+			sid, code, m.Statuses[code])
+	}
+
+	header("petrel_requests_total", "counter", "Requests handled, by handler and status.")
+	for _, name := range names {
+		h := m.Handlers[name]
+		for _, code := range sortedKeys(h.Statuses) {
+			fmt.Fprintf(bw, "petrel_requests_total{%s,handler=%s,status=\"%d\"} %d\n",
+				sid, promQuote(name), code, h.Statuses[code])
+		}
+	}
+	header("petrel_request_bytes_total", "counter", "Request payload bytes, by handler.")
+	for _, name := range names {
+		fmt.Fprintf(bw, "petrel_request_bytes_total{%s,handler=%s} %d\n",
+			sid, promQuote(name), m.Handlers[name].BytesIn)
+	}
+	header("petrel_response_bytes_total", "counter", "Response payload bytes, by handler.")
+	for _, name := range names {
+		fmt.Fprintf(bw, "petrel_response_bytes_total{%s,handler=%s} %d\n",
+			sid, promQuote(name), m.Handlers[name].BytesOut)
+	}
+
+	header("petrel_request_duration_seconds", "histogram",
+		"Request handling time, by handler.")
+	for _, name := range names {
+		h := m.Handlers[name]
+		labels := sid + ",handler=" + promQuote(name)
+		for i, le := range h.Latency.Buckets {
+			fmt.Fprintf(bw, "petrel_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(le, 'g', -1, 64), h.Latency.Counts[i])
+		}
+		fmt.Fprintf(bw, "petrel_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, h.Latency.Count)
+		fmt.Fprintf(bw, "petrel_request_duration_seconds_sum{%s} %s\n",
+			labels, strconv.FormatFloat(h.Latency.Sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "petrel_request_duration_seconds_count{%s} %d\n",
+			labels, h.Latency.Count)
+	}
+	return bw.Flush()
+}
+
+// sortedKeys returns the keys of m, in order
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// promQuote quotes a Prometheus label value
+func promQuote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
@@ -7,12 +7,129 @@ package server
 // Socket code for petrel
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	p "github.com/firepear/petrel"
 )
 
+// listen creates the listener socket for a Server
+func listen(c *Config) (net.Listener, error) {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+	switch c.Network {
+	case "tcp":
+		tcpaddr, err := net.ResolveTCPAddr("tcp", c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.ListenTCP("tcp", tcpaddr)
+		if err != nil {
+			return nil, err
+		}
+		if c.TLS != nil {
+			return tls.NewListener(l, c.TLS), nil
+		}
+		return l, nil
+	case "unix":
+		abstract := strings.HasPrefix(c.Addr, "@")
+		if !abstract {
+			if err := clearStaleSock(c.Addr); err != nil {
+				return nil, err
+			}
+		}
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: c.Addr, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		// socket files are removed when the listener closes
+		l.SetUnlinkOnClose(true)
+		if !abstract {
+			if err = setSockPerms(c); err != nil {
+				_ = l.Close()
+				return nil, err
+			}
+		}
+		if c.TLS != nil {
+			return tls.NewListener(l, c.TLS), nil
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("unsupported network '%s'", c.Network)
+}
+
+// clearStaleSock removes a unix socket file left behind by a server
+// which did not shut down cleanly. A socket file which something is
+// still listening on is left alone, as is anything which is not a
+// socket.
+func clearStaleSock(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, 100*time.Millisecond)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// setSockPerms applies Config.SockMode and Config.SockOwner to a
+// unix socket file
+func setSockPerms(c *Config) error {
+	if c.SockMode != 0 {
+		if err := os.Chmod(c.Addr, c.SockMode); err != nil {
+			return err
+		}
+	}
+	if c.SockOwner == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	usr, grp, _ := strings.Cut(c.SockOwner, ":")
+	if usr != "" {
+		u, err := user.Lookup(usr)
+		if err != nil {
+			u, err = user.LookupId(usr)
+		}
+		if err != nil {
+			return fmt.Errorf("bad SockOwner user: %w", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if grp != "" {
+		g, err := user.LookupGroup(grp)
+		if err != nil {
+			g, err = user.LookupGroupId(grp)
+		}
+		if err != nil {
+			return fmt.Errorf("bad SockOwner group: %w", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(c.Addr, uid, gid)
+}
+
 // sockAccept is spawned by server.commonNew. It monitors the server's
 // listener socket and spawns connections for clients.
 func (s *Server) sockAccept() {
@@ -48,10 +165,21 @@ func (s *Server) sockAccept() {
 		pc.NC = nc
 		pc.Plim = s.rl
 		pc.Hkey = s.hk
-		pc.Timeout = time.Duration(s.t) * time.Millisecond
+		pc.Timeout = s.t
+		pc.IdleTimeout = s.ti
+		pc.HeaderTimeout = s.th
+		pc.PayloadTimeout = s.tp
+		pc.WriteTimeout = s.tw
+		pc.MinRate = s.mr
 
 		// increment our waitgroup
 		s.w.Add(1)
+		// turn the connection away if we're at a limit
+		if why := s.lim.admit(nc.RemoteAddr()); why != "" {
+			go s.reject(pc, why, s.lim.holdReject())
+			continue
+		}
+		s.met.conn(true)
 		// add to connlist
 		s.cl.Store(id, pc)
 		// and launch the goroutine which will actually
@@ -62,18 +190,66 @@ func (s *Server) sockAccept() {
 
 // connServer dispatches commands from, and sends reponses to, a
 // client. It is launched, per-connection, from sockAccept().
+//
+// Requests are read sequentially, but each one is handled in its own
+// goroutine, so a slow Handler does not hold up other requests on
+// the same connection. Replies carry the Seq of the request which
+// caused them, and may be sent in a different order than the requests
+// were received.
 func (s *Server) connServer(c *p.Conn) {
+	// hw tracks this connection's in-flight handlers
+	hw := &sync.WaitGroup{}
 	// queue up decrementing the waitlist, closing the network
-	// connection, and removing the connlist entry
+	// connection, and removing the connlist entry. in-flight
+	// handlers are allowed to finish before the conn is closed.
+	// ctx is handed to handlers, and is cancelled when the
+	// connection drops (or the Server quits). when the Server is
+	// draining, handlers keep an uncancelled ctx until they're
+	// done, and the conn stays in the connlist so that it can be
+	// cut if they run out of time
+	ctx, cancel := context.WithCancel(s.ctx)
 	defer s.w.Done()
 	defer func() { _ = c.NC.Close() }()
+	defer s.lim.release(c)
+	if s.ipb != nil {
+		defer s.ipb.sweep()
+	}
 	defer s.cl.Delete(c.Id)
+	defer cancel()
+	defer hw.Wait()
+	defer func() {
+		if !s.dr.Load() {
+			cancel()
+		}
+	}()
+	// streamed request bodies still being received, by Seq. any
+	// which are unfinished when the conn closes are cut short,
+	// before waiting on the handlers reading them
+	bodies := map[uint32]*body{}
+	defer func() {
+		for _, b := range bodies {
+			b.end(io.ErrUnexpectedEOF)
+		}
+	}()
 	c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: c.Resp.Req, Code: 100,
 		Txt: fmt.Sprintf("srv:%s %s %s", s.sid, p.Stats[100].Txt,
 			c.NC.RemoteAddr().String()),
 		Err: nil}
-
-	var response []byte
+	// rate limiting state
+	ip := remoteIP(c.NC.RemoteAddr())
+	var cb *bucket
+	if s.cr.Limit > 0 {
+		cb = newBucket(s.cr)
+	}
+	// in-flight request slots. one is taken before a handler is
+	// launched, and given back when it has replied
+	sem := make(chan struct{}, s.mif)
+	// the identity the connection authenticated as. it is taken
+	// once, when the handshake completes, and is what every
+	// later request is made as
+	var ident *p.Identity
+	// the handshake has been done
+	shook := false
 
 	for {
 		// let us forever enshrine the dumbness of the
@@ -83,8 +259,29 @@ func (s *Server) connServer(c *p.Conn) {
 		// req, payload, perr, xtra, err := p.ConnRead(c, s.t, s.rl, s.hk, &reqid)
 		// perr, err = p.ConnWrite(c, req, p.Stats[perr].Xmit, s.hk, s.t, reqid)
 
+		// stop reading if the Server is shutting down
+		if s.dr.Load() {
+			break
+		}
 		// read the request
 		err := p.ConnRead(c)
+		if err != nil && s.dr.Load() {
+			// GracefulQuit interrupted our read. in-flight
+			// requests finish before we close
+			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: c.Resp.Req,
+				Code: 197, Txt: p.Stats[197].Txt, Err: nil}
+			break
+		}
+		if c.Resp.Status == 490 {
+			// idle timeout. the client is told with a push,
+			// as a request may still be in flight, and its
+			// response will be sent before we close
+			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: c.Resp.Req,
+				Code: 490, Txt: p.Stats[490].Txt, Err: err}
+			_ = p.ConnSend(c, &p.Resp{Status: 490, Flags: p.FlagPush,
+				Req: "IDLE"})
+			break
+		}
 		if err != nil || c.Resp.Status > 399 {
 			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: c.Resp.Req,
 				Code: c.Resp.Status, Txt: p.Stats[c.Resp.Status].Txt,
@@ -95,31 +292,284 @@ func (s *Server) connServer(c *p.Conn) {
 				[]byte(fmt.Sprintf("%s", err)))
 			break
 		}
-		// lookup the handler for this request
-		handler, ok := s.d[c.Resp.Req]
-		if ok {
-			// dispatch the request and get the response
-			c.Resp.Status, response, err = handler(c.Resp.Payload)
-			if err != nil {
-				c.Resp.Status = 500
+		// take a copy of the request, since c.Resp will be
+		// overwritten by the next read
+		req := c.Resp
+		if req.Req == "PROTOCHECK" {
+			if shook {
+				// a connection is authenticated, and
+				// counted against its limits, once
+				c.Msgr <- &p.Msg{Cid: c.Sid, Seq: req.Seq, Req: req.Req,
+					Code: 497, Txt: "repeated PROTOCHECK", Err: nil}
+				_ = p.ConnSend(c, &p.Resp{Status: 497, Seq: req.Seq,
+					Req: req.Req, Payload: p.Proto})
+				break
+			}
+			// the handshake is handled before anything
+			// else is read, so that its outcome is known
+			// to every request which follows
+			hw.Add(1)
+			if s.reqDispatch(ctx, c, &req, nil, nil, hw) != 200 {
+				// authentication failed, or the conn
+				// is over a limit
+				break
+			}
+			ident = c.Ident
+			shook = true
+			hello, _ := parseHello(req.Payload)
+			c.SetCompression(s.compressor(hello), s.cmin)
+			continue
+		}
+		if b, ok := bodies[req.Seq]; ok {
+			// the next chunk of a streamed request body
+			b.push(ctx, req.Payload)
+			if req.Flags&p.FlagEOS != 0 {
+				b.end(nil)
+				delete(bodies, req.Seq)
+			}
+			continue
+		}
+		// the first chunk of a streamed request body begins
+		// the body. if the request is refused, the rest of the
+		// body is still read, and discarded
+		var b *body
+		if req.Flags&(p.FlagStream|p.FlagEOS) != 0 {
+			b = newBody()
+			if req.Flags&p.FlagEOS == 0 {
+				bodies[req.Seq] = b
+			}
+		}
+		if s.auth != nil && ident == nil {
+			// no requests allowed until authenticated
+			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: req.Seq, Req: req.Req,
+				Code: 496, Txt: "request before authentication", Err: nil}
+			_ = p.ConnSend(c, &p.Resp{Status: 496, Seq: req.Seq, Req: req.Req})
+			break
+		}
+		if wait := s.throttle(ip, cb); wait > 0 {
+			// over a rate limit. refuse the request, but
+			// keep the connection
+			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: req.Seq, Req: req.Req,
+				Code: 429, Txt: p.Stats[429].Txt, Err: nil}
+			hint := retryAfter(wait)
+			_ = p.ConnSend(c, &p.Resp{Status: 429, Seq: req.Seq,
+				Req: req.Req, Payload: hint})
+			if _, ok := s.d[req.Req]; ok {
+				s.met.request(req.Req, 429, len(req.Payload), len(hint), 0)
+			}
+			if b != nil {
+				b.stop()
+			}
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			// too many requests already in flight. refuse
+			// this one, but keep the connection
+			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: req.Seq, Req: req.Req,
+				Code: 430, Txt: p.Stats[430].Txt, Err: nil}
+			_ = p.ConnSend(c, &p.Resp{Status: 430, Seq: req.Seq, Req: req.Req})
+			if _, ok := s.d[req.Req]; ok {
+				s.met.request(req.Req, 430, len(req.Payload), 0, 0)
+			}
+			if b != nil {
+				b.stop()
+			}
+			continue
+		}
+		// hand off the request
+		hw.Add(1)
+		go func() {
+			defer func() { <-sem }()
+			s.reqDispatch(ctx, c, &req, b, ident, hw)
+		}()
+		if b != nil {
+			// the handler has the first chunk now. a
+			// one-chunk body is complete
+			b.push(ctx, req.Payload)
+			if req.Flags&p.FlagEOS != 0 {
+				b.end(nil)
 			}
-		} else {
-			// unknown handler
-			c.Resp.Status = 400
 		}
+	}
+}
 
-		// we always send a response
-		err = p.ConnWrite(c, []byte(c.Resp.Req), response)
-		if c.Resp.Status > 1024 {
-			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: c.Resp.Req,
-				Code: c.Resp.Status, Txt: "app defined code", Err: err}
+// reqDispatch runs the handler for a single request and sends its
+// response. It is launched, per-request, from connServer(), and
+// returns the status that was sent. b is the request's body, if it
+// is being streamed, and ident is the connection's identity.
+func (s *Server) reqDispatch(ctx context.Context, c *p.Conn, req *p.Resp, b *body, ident *p.Identity, hw *sync.WaitGroup) uint16 {
+	defer hw.Done()
+	if b != nil {
+		defer b.stop()
+	}
+	var response []byte
+	var err error
+	var flags uint8
+	var sw *streamWriter
+	status := uint16(400)
+	start := time.Now()
+
+	// lookup the handler for this request
+	h, ok := s.d[req.Req]
+	if ok && b != nil && !h.body {
+		// a streamed body for a handler which can't take one
+		status = 422
+		response = []byte("handler does not take a streamed body")
+	} else if ok {
+		r := &Request{Id: c.Id, Sid: c.Sid, Seq: req.Seq, Name: req.Req,
+			Payload: req.Payload, RemoteAddr: c.NC.RemoteAddr(),
+			Ident: ident, conn: c}
+		if tc, ok := c.NC.(*tls.Conn); ok {
+			cs := tc.ConnectionState()
+			r.TLS = &cs
+		}
+		if b != nil {
+			// the payload was the first chunk of the
+			// body, and is read from there
+			r.Payload = nil
+			r.body = b
+		}
+		if h.stream {
+			// stream chunks are sent as the handler
+			// produces them, leaving only the
+			// end-of-stream marker for us
+			sw = &streamWriter{c: c, req: req}
+			r.w = sw
+			flags = p.FlagEOS
+		}
+		span := s.startSpan(req, r)
+		if span != nil {
+			ctx = p.ContextWithTrace(ctx, r.Trace)
+			defer func() {
+				if b != nil {
+					span.BytesIn = int(b.n.Load())
+				}
+				s.endSpan(span, status, response, sw, err)
+			}()
+		}
+		// dispatch the request and get the response
+		if s.tx > 0 {
+			status, response, err = s.timedCall(ctx, h, r)
 		} else {
-			c.Msgr <- &p.Msg{Cid: c.Sid, Seq: c.Seq, Req: c.Resp.Req,
-				Code: c.Resp.Status, Txt: p.Stats[c.Resp.Status].Txt,
-				Err: err}
+			status, response, err = s.chain(h)(ctx, r)
 		}
 		if err != nil {
-			break
+			status = 500
 		}
 	}
+
+	// we always send a response. if sending fails, the write
+	// error replaces any handler error in the log
+	resp := &p.Resp{Status: status, Seq: req.Seq, Flags: flags,
+		Req: req.Req, Payload: response}
+	var werr error
+	if sw != nil {
+		werr = sw.end(resp)
+	} else {
+		werr = p.ConnSend(c, resp)
+	}
+	if werr != nil {
+		status = p.WriteStatus(werr)
+		err = werr
+	}
+	if ok {
+		out := len(response)
+		if sw != nil {
+			out += int(sw.n.Load())
+		}
+		in := len(req.Payload)
+		if b != nil {
+			in = int(b.n.Load())
+		}
+		s.met.request(req.Req, status, in, out, time.Since(start))
+	}
+	if status > 1024 {
+		c.Msgr <- &p.Msg{Cid: c.Sid, Seq: req.Seq, Req: req.Req,
+			Code: status, Txt: "app defined code", Err: err}
+	} else {
+		c.Msgr <- &p.Msg{Cid: c.Sid, Seq: req.Seq, Req: req.Req,
+			Code: status, Txt: p.Stats[status].Txt, Err: err}
+	}
+	if werr != nil {
+		// a failed write leaves the connection in an unknown
+		// state. closing it will stop connServer's read loop
+		_ = c.NC.Close()
+	}
+	return status
+}
+
+// timedCall runs a handler subject to the Server's HandlerTimeout. If
+// the handler does not return in time, its context is cancelled and
+// status 494 is returned without waiting for it.
+func (s *Server) timedCall(ctx context.Context, h *handler, r *Request) (uint16, []byte, error) {
+	type result struct {
+		status   uint16
+		response []byte
+		err      error
+	}
+	tctx, cancel := context.WithTimeout(ctx, s.tx)
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		status, response, err := s.chain(h)(tctx, r)
+		done <- result{status, response, err}
+	}()
+	select {
+	case res := <-done:
+		return res.status, res.response, res.err
+	case <-tctx.Done():
+		if ctx.Err() != nil {
+			// not a timeout; the conn or the Server is
+			// going down. wait, as we would without a
+			// HandlerTimeout
+			res := <-done
+			return res.status, res.response, res.err
+		}
+		// the handler may still be writing. the end of
+		// the stream is sent under the streamWriter's
+		// lock, so no chunk can follow it
+		return 494, nil, nil
+	}
+}
+
+// streamWriter is the io.Writer handed to a StreamHandler. Each Write
+// sends one chunk of the stream.
+type streamWriter struct {
+	c   *p.Conn
+	req *p.Resp
+	// mu is held across each send, so that the end of the stream
+	// cannot be sent while a chunk is going out
+	mu sync.Mutex
+	// the stream has been ended
+	done bool
+	// bytes sent
+	n atomic.Uint64
+}
+
+// Write sends b to the client as a stream chunk, under the Seq of the
+// originating request.
+func (w *streamWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return 0, fmt.Errorf("%s: stream has ended", p.Stats[494].Txt)
+	}
+	err := p.ConnSend(w.c, &p.Resp{Status: 200, Seq: w.req.Seq,
+		Flags: p.FlagStream, Req: w.req.Req, Payload: b})
+	if err != nil {
+		return 0, err
+	}
+	w.n.Add(uint64(len(b)))
+	return len(b), nil
+}
+
+// end sends r, the end-of-stream marker. Writes which come after it
+// fail.
+func (w *streamWriter) end(r *p.Resp) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	return p.ConnSend(w.c, r)
 }
@@ -0,0 +1,171 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Request rate limiting
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate is a request rate limit, enforced with a token bucket. Requests
+// may arrive at an average of Limit per second, with bursts of up to
+// Burst requests at once. A Rate with a Limit of zero is no limit.
+//
+// Requests over a limit are refused with status 429. Its payload is
+// a hint for how long the client should wait before trying again, in
+// milliseconds, as a decimal string.
+type Rate struct {
+	// Limit is the number of requests allowed per second
+	Limit float64 `json:"limit"`
+	// Burst is the number of requests which may be made at once.
+	// If it is less than 1, it is taken to be 1.
+	Burst int `json:"burst"`
+}
+
+// bucket is a token bucket
+type bucket struct {
+	mu     sync.Mutex
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(r Rate) *bucket {
+	r.Burst = max(r.Burst, 1)
+	return &bucket{rate: r, tokens: float64(r.Burst), last: time.Now()}
+}
+
+// fill adds the tokens earned since the bucket was last
+// touched. b.mu must be held.
+func (b *bucket) fill(now time.Time) {
+	b.tokens = min(float64(b.rate.Burst),
+		b.tokens+now.Sub(b.last).Seconds()*b.rate.Limit)
+	b.last = now
+}
+
+// take removes a token from the bucket. If there are none, it
+// returns how long it will be until there is one.
+func (b *bucket) take() time.Duration {
+	return takeAll(b)
+}
+
+// takeAll removes a token from each of the buckets, if all of them
+// have one. If any do not, it takes none, and returns how long it
+// will be until they all do. Buckets are locked in the order given,
+// so callers which pass more than one must agree on an order.
+func takeAll(bs ...*bucket) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range bs {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.fill(now)
+		if b.tokens < 1 {
+			wait = max(wait, time.Duration((1-b.tokens)/b.rate.Limit*float64(time.Second)))
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range bs {
+		b.tokens--
+	}
+	return 0
+}
+
+// full reports whether the bucket has refilled completely, in which
+// case it is no different from a new one
+func (b *bucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill(time.Now())
+	return b.tokens >= float64(b.rate.Burst)
+}
+
+// ipBuckets holds the per-IP buckets for a Server
+type ipBuckets struct {
+	mu   sync.Mutex
+	rate Rate
+	b    map[string]*bucket
+}
+
+// get returns the bucket for ip
+func (ib *ipBuckets) get(ip string) *bucket {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	b, ok := ib.b[ip]
+	if !ok {
+		b = newBucket(ib.rate)
+		ib.b[ip] = b
+	}
+	return b
+}
+
+// sweep discards buckets which have refilled, so that the map does
+// not grow without bound
+func (ib *ipBuckets) sweep() {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	for ip, b := range ib.b {
+		if b.full() {
+			delete(ib.b, ip)
+		}
+	}
+}
+
+// throttle applies the Server's per-IP rate limit, and the
+// connection's limit (cb, which may be nil) to a request. It returns
+// zero if the request may proceed, or how long the client should
+// wait if it may not. A token is taken from each limit only if both
+// allow the request, so that one refusing it does not use up the
+// other.
+func (s *Server) throttle(ip string, cb *bucket) time.Duration {
+	bs := make([]*bucket, 0, 2)
+	if cb != nil {
+		bs = append(bs, cb)
+	}
+	if ip != "" && s.ipb != nil {
+		bs = append(bs, s.ipb.get(ip))
+	}
+	if len(bs) == 0 {
+		return 0
+	}
+	return takeAll(bs...)
+}
+
+// retryAfter formats a wait as the payload of a 429 response
+func retryAfter(wait time.Duration) []byte {
+	ms := int64(math.Ceil(float64(wait) / float64(time.Millisecond)))
+	return []byte(strconv.FormatInt(ms, 10))
+}
+
+// RateLimit returns a Middleware which limits the rate of requests to
+// the handlers it wraps. Passed to Register, it limits one handler,
+// across all connections:
+//
+//	s.Register("search", search, server.RateLimit(server.Rate{Limit: 50, Burst: 10}))
+//
+// Each call to RateLimit creates a separate bucket, so the same
+// Middleware may be passed to several Register calls to make them
+// share a limit.
+func RateLimit(r Rate) Middleware {
+	if r.Limit <= 0 {
+		return func(next HandlerCtx) HandlerCtx { return next }
+	}
+	b := newBucket(r)
+	return func(next HandlerCtx) HandlerCtx {
+		return func(ctx context.Context, req *Request) (uint16, []byte, error) {
+			if wait := b.take(); wait > 0 {
+				return 429, retryAfter(wait), nil
+			}
+			return next(ctx, req)
+		}
+	}
+}
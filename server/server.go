@@ -5,17 +5,27 @@ package server
 // BSD-style license that can be found in the LICENSE file.
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	p "github.com/firepear/petrel"
 )
 
+// DefaultMaxInFlight is the number of requests which may be handled
+// at once on a connection, if Config.MaxInFlight is not set.
+const DefaultMaxInFlight = 256
+
 // Server is a Petrel server instance.
 type Server struct {
 	// Msgr is the internal-facing channel which receives
@@ -24,27 +34,67 @@ type Server struct {
 	// Shutdown is the external-facing channel which notifies
 	// applications that a Server instance is shutting down
 	Shutdown chan error
-	id       string             // server id
-	sid      string             // short id
-	q        chan bool          // quit signal socket
-	s        string             // socket name
-	l        net.Listener       // listener socket
-	log      *slog.Logger       // Logger instance
-	d        map[string]Handler // dispatch table
-	cl       *sync.Map          // connection list
-	t        time.Duration      // timeout
-	rl       uint32             // request length
-	hk       []byte             // HMAC key
+	id       string              // server id
+	sid      string              // short id
+	q        chan bool           // quit signal socket
+	s        string              // socket name
+	l        net.Listener        // listener socket
+	log      *slog.Logger        // Logger instance
+	d        map[string]*handler // dispatch table
+	mw       []Middleware        // server-wide middleware
+	auth     Authenticator       // PROTOCHECK authenticator
+	cl       *sync.Map           // connection list
+	lim      *connLimits         // connection limits
+	cr       Rate                // per-connection rate limit
+	ipb      *ipBuckets          // per-ip rate limits
+	mif      int                 // max in-flight requests per conn
+	t        time.Duration       // timeout
+	ti       time.Duration       // idle timeout
+	th       time.Duration       // header timeout
+	tp       time.Duration       // payload timeout
+	tw       time.Duration       // write timeout
+	tx       time.Duration       // handler timeout
+	mr       uint32              // min payload rate
+	st       time.Time           // start time
+	met      *metrics            // metrics
+	tr       p.Tracer            // span reporting
+	cdc      p.Codec             // typed payload encoding
+	comp     []string            // allowed compressors
+	cmin     int                 // compression threshold
+	rl       uint32              // request length
+	hk       []byte              // HMAC key
 	w        *sync.WaitGroup
+	so       sync.Once   // stop once
+	fo       sync.Once   // finish once
+	dr       atomic.Bool // draining for GracefulQuit
 	logd     map[string]func(string, ...any)
+	ctx      context.Context    // cancelled on Quit
+	cancel   context.CancelFunc // cancels ctx
 }
 
 // Config holds values to be passed to server constuctors.
 type Config struct {
 	// Addr is the IP+port of the socket, e.g."127.0.0.1:9090"
-	// or "[::1]:9090".
+	// or "[::1]:9090". For unix domain sockets, it is the path
+	// of the socket file, or a name beginning with '@' for a
+	// Linux abstract socket.
 	Addr string
 
+	// Network is the type of socket to listen on: "tcp" or
+	// "unix". Default (empty) is "tcp".
+	Network string
+
+	// SockMode is the permission mode for a unix domain socket
+	// file. Default (0) leaves the mode as created, which is
+	// subject to the process umask.
+	SockMode os.FileMode
+
+	// SockOwner is the ownership for a unix domain socket file,
+	// in the same format as chown(1): "user", "user:group", or
+	// ":group". Users and groups may be names or numeric
+	// ids. Default (empty) leaves ownership as created.
+	SockOwner string
+
 	// TLS is a crypto/tls configuration struct. If it is present,
 	// then the server will be TLS-enabled.
 	TLS *tls.Config
@@ -60,8 +110,44 @@ type Config struct {
 	// handled in a separate goroutine, however, so one blocked
 	// connection does not affect any others (unless you run out of
 	// file descriptors for new conns).
+	//
+	// Timeout is the default for each of the network timeouts
+	// below which is zero.
 	Timeout int64
 
+	// IdleTimeout is the number of milliseconds a connection may
+	// sit idle between requests before it is closed (status 490).
+	IdleTimeout int64
+
+	// HeaderTimeout is the number of milliseconds allowed to read
+	// a request's header and name, once it has begun to arrive
+	// (status 491).
+	HeaderTimeout int64
+
+	// PayloadTimeout is the number of milliseconds allowed to
+	// read a request's payload, once its header has been read
+	// (status 492).
+	PayloadTimeout int64
+
+	// MinRate is the slowest rate, in bytes per second, at which
+	// a payload may arrive. It lengthens PayloadTimeout in
+	// proportion to the size of the payload, so that large
+	// requests are not cut off while clients which trickle data
+	// in are. Default (0) is no minimum.
+	MinRate uint32
+
+	// WriteTimeout is the number of milliseconds allowed to send
+	// a response (status 493).
+	WriteTimeout int64
+
+	// HandlerTimeout is the number of milliseconds a handler may
+	// run for. When it expires, the handler's context is
+	// cancelled and the client is sent status 494; anything the
+	// handler returns afterward is discarded. Unlike the network
+	// timeouts, it does not default to Timeout, and the
+	// connection is not closed. Default (zero) is no timeout.
+	HandlerTimeout int64
+
 	// Xferlim is the maximum number of bytes in a single read
 	// from the network. If a request exceeds this limit, the
 	// connection will be dropped. Use this to prevent memory
@@ -84,8 +170,82 @@ type Config struct {
 	// is full are dropped on the floor to prevent the Server from
 	// blocking. Defaults to 64.
 	Buffer int
+
+	// Authenticator, if set, is called during the PROTOCHECK
+	// handshake to accept or reject each connection based on the
+	// Credentials sent by the client. Rejected connections are
+	// closed, as are connections which make any request before
+	// authenticating. Default (nil) is to accept all connections.
+	Authenticator Authenticator
+
+	// MaxConns is the maximum number of connections which may be
+	// open at once. Default (0) is unlimited.
+	MaxConns int
+
+	// MaxConnsPerIP is the maximum number of connections which
+	// may be open at once from a single remote IP address. It
+	// does not apply to unix domain sockets. Default (0) is
+	// unlimited.
+	MaxConnsPerIP int
+
+	// MaxConnsPerIdent is the maximum number of connections which
+	// may be authenticated as a single Identity (by Name) at
+	// once. It is checked during the PROTOCHECK handshake.
+	// Default (0) is unlimited.
+	MaxConnsPerIdent int
+
+	// ConnRate limits the rate of requests on each connection.
+	// Requests over the limit are refused with status 429, but
+	// the connection stays open. Default (zero) is unlimited.
+	ConnRate Rate
+
+	// MaxInFlight is the maximum number of requests which may
+	// be handled at once on a single connection. Requests over
+	// the limit are refused with status 430, but the connection
+	// stays open. Default (0) is DefaultMaxInFlight.
+	MaxInFlight int
+
+	// IPRate limits the rate of requests from each remote IP
+	// address, across all of its connections. It does not apply
+	// to unix domain sockets. Default (zero) is unlimited.
+	IPRate Rate
+
+	// Tracer, if set, receives a span for every request the
+	// Server handles. Requests which arrive with a trace context
+	// are traced whether or not a Tracer is set, so that
+	// handlers can pass the trace on to requests of their
+	// own. Default (nil) is petrel.NopTracer.
+	Tracer p.Tracer
+
+	// Codec encodes and decodes the payloads of handlers
+	// registered with RegisterTyped. Default (nil) is
+	// petrel.JSONCodec.
+	Codec p.Codec
+
+	// Compress lists the Compressors (by name) the Server will
+	// use. A connection uses the first Compressor in the client's
+	// list which is also in this one. Default (nil) is no
+	// compression.
+	Compress []string
+
+	// CompressMin is the size, in bytes, below which payloads are
+	// sent uncompressed. Default (0) is
+	// petrel.DefaultCompressMin. Xferlim applies to payloads
+	// both as sent and once decompressed.
+	CompressMin int
 }
 
+// Authenticator is the type of Config.Authenticator. It is given the
+// Credentials sent by a client (which will be empty if the client
+// sent none), along with the PROTOCHECK Request itself, so that the
+// remote address and TLS state are available.
+//
+// To accept the connection, it returns the Identity the client has
+// authenticated as, which is then stored on the connection's
+// petrel.Conn and passed to handlers in Request.Ident. To reject the
+// connection, it returns a non-nil error, or a nil Identity.
+type Authenticator func(creds *p.Credentials, req *Request) (*p.Identity, error)
+
 // Handler is the type which functions passed to Server.Register must
 // match: taking a slice of bytes as an argument; and returning a
 // uint16 (indicating status), a slice of bytes (the response), and an
@@ -99,18 +259,92 @@ type Config struct {
 // 65535, as they see fit.
 type Handler func([]byte) (uint16, []byte, error)
 
+// StreamHandler is the type which functions passed to
+// Server.RegisterStream must match. Like a Handler, it takes the
+// request payload as an argument. Rather than returning a response
+// payload, it writes any number of chunks to w; each call to
+// w.Write is sent to the client immediately, as a separate
+// transmission. When the StreamHandler returns, its status is sent
+// to the client as the end-of-stream marker.
+//
+// A StreamHandler should return promptly if a write to w fails, as
+// that means the client connection is no longer usable.
+type StreamHandler func([]byte, io.Writer) (uint16, error)
+
+// HandlerCtx is the type which functions passed to
+// Server.RegisterCtx must match. It is like a Handler, but instead of
+// only the request payload it receives a Request, which describes the
+// request and the connection it arrived on.
+//
+// ctx is cancelled when the client's connection closes, or when the
+// Server's Quit method is called. Long-running HandlerCtx funcs
+// should watch it, and give up when it is done.
+type HandlerCtx func(ctx context.Context, req *Request) (uint16, []byte, error)
+
+// Request is a request as seen by a HandlerCtx.
+type Request struct {
+	// Id is the id of the connection the request arrived on
+	Id string
+	// Sid is the short id of the connection
+	Sid string
+	// Seq is the request's sequence number
+	Seq uint32
+	// Name is the name the request was made under
+	Name string
+	// Payload is the request payload
+	Payload []byte
+	// RemoteAddr is the network address of the client
+	RemoteAddr net.Addr
+	// TLS holds the state of the connection's TLS session. It is
+	// nil if the connection is not TLS-enabled.
+	TLS *tls.ConnectionState
+	// Ident is the identity the connection authenticated as. If
+	// the Server has no Authenticator, it is taken from the TLS
+	// client certificate, and is nil if there is none.
+	Ident *p.Identity
+	// Trace is the request's trace context. It is zero unless the
+	// request is being traced, in which case the handler's
+	// context carries it too, so that requests made with that
+	// context are part of the same trace.
+	Trace p.Trace
+	// the connection the request arrived on
+	conn *p.Conn
+	// stream chunk writer, for StreamHandlers
+	w io.Writer
+	// streamed request body, for BodyHandlers
+	body *body
+}
+
+// Middleware wraps a HandlerCtx, returning a new HandlerCtx which
+// does some work before and/or after calling the one it was given
+// ('next'). It is the place for things which need to happen for
+// many handlers: logging, checks, metrics, and so on.
+//
+// A Middleware may short-circuit a request by returning its own
+// status and payload without calling next at all, in which case the
+// handler never runs.
+type Middleware func(next HandlerCtx) HandlerCtx
+
+// handler is a dispatch table entry. All types of handler func are
+// wrapped as a HandlerCtx.
+type handler struct {
+	fn HandlerCtx
+	// per-handler middleware
+	mw []Middleware
+	// stream is true for StreamHandlers, whose response is sent
+	// in chunks as the handler runs
+	stream bool
+	// body is true for BodyHandlers, which take streamed request
+	// bodies
+	body bool
+	// description, for PETREL.HANDLERS
+	desc string
+}
+
 // New returns a new Server, ready to have handlers added.
 func New(c *Config) (*Server, error) {
-	var l net.Listener
-	var err error
-
 	// create our listener
-	if c.TLS != nil {
-		l, err = tls.Listen("tcp", c.Addr, c.TLS)
-	} else {
-		tcpaddr, _ := net.ResolveTCPAddr("tcp", c.Addr)
-		l, err = net.ListenTCP("tcp", tcpaddr)
-	}
+	l, err := listen(c)
 	if err != nil {
 		return nil, err
 	}
@@ -128,13 +362,14 @@ func New(c *Config) (*Server, error) {
 
 	// generate id and short id
 	id, sid := p.GenId()
+	ctx, cancel := context.WithCancel(context.Background())
 
 	// create the Server, start listening, and return
 	s := &Server{
 		Msgr:     make(chan *p.Msg, c.Buffer),
 		Shutdown: make(chan error, 4),
 		q:        make(chan bool, 1),
-		d:        make(map[string]Handler),
+		d:        make(map[string]*handler),
 		logd:     make(map[string]func(string, ...any), 5),
 		id:       id,
 		sid:      sid,
@@ -142,10 +377,44 @@ func New(c *Config) (*Server, error) {
 		l:        l,
 		log:      c.Logger,
 		cl:       &sync.Map{},
+		lim:      newConnLimits(c),
+		cr:       c.ConnRate,
+		mif:      c.MaxInFlight,
 		t:        time.Duration(c.Timeout) * time.Millisecond,
+		ti:       time.Duration(c.IdleTimeout) * time.Millisecond,
+		th:       time.Duration(c.HeaderTimeout) * time.Millisecond,
+		tp:       time.Duration(c.PayloadTimeout) * time.Millisecond,
+		tw:       time.Duration(c.WriteTimeout) * time.Millisecond,
+		tx:       time.Duration(c.HandlerTimeout) * time.Millisecond,
+		mr:       c.MinRate,
+		st:       time.Now(),
+		met:      newMetrics(),
+		tr:       c.Tracer,
+		cdc:      c.Codec,
+		comp:     c.Compress,
+		cmin:     c.CompressMin,
 		rl:       c.Xferlim,
 		hk:       c.HMACKey,
+		auth:     c.Authenticator,
 		w:        &sync.WaitGroup{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	if s.tr == nil {
+		s.tr = p.NopTracer{}
+	}
+	if s.cdc == nil {
+		s.cdc = p.JSONCodec
+	}
+	if s.cmin == 0 {
+		s.cmin = p.DefaultCompressMin
+	}
+	if s.mif == 0 {
+		s.mif = DefaultMaxInFlight
+	}
+	if c.IPRate.Limit > 0 {
+		s.ipb = &ipBuckets{rate: c.IPRate, b: map[string]*bucket{}}
 	}
 
 	// add one to waitgroup for s.sockAccept()
@@ -164,8 +433,11 @@ func New(c *Config) (*Server, error) {
 	go s.sockAccept()
 
 	// register the PROTOCHECK handler, called by all clients
-	// during connection
-	err = s.Register("PROTOCHECK", protocheck)
+	// during connection, and the PING handler
+	err = s.RegisterCtx("PROTOCHECK", s.protocheck)
+	if err == nil {
+		err = s.Register("PING", ping)
+	}
 	if err == nil {
 		s.log.Debug("petrel server up", "sid", s.sid, "addr", c.Addr)
 	}
@@ -180,46 +452,248 @@ func New(c *Config) (*Server, error) {
 // for.
 //
 // 'r' is the name of the Handler function which will be called on dispatch.
-func (s *Server) Register(name string, r Handler) error {
+//
+// 'mw' is optional Middleware which applies only to this handler. It
+// runs inside any Middleware added with Use, and the first one given
+// is the outermost.
+func (s *Server) Register(name string, r Handler, mw ...Middleware) error {
+	return s.register(name, &handler{
+		fn: func(_ context.Context, req *Request) (uint16, []byte, error) {
+			return r(req.Payload)
+		},
+		mw: mw})
+}
+
+// RegisterCtx adds a HandlerCtx function to a Server. Its arguments
+// are the same as those of Register.
+func (s *Server) RegisterCtx(name string, r HandlerCtx, mw ...Middleware) error {
+	return s.register(name, &handler{fn: r, mw: mw})
+}
+
+// RegisterStream adds a StreamHandler function to a Server. Its
+// arguments are the same as those of Register.
+func (s *Server) RegisterStream(name string, r StreamHandler, mw ...Middleware) error {
+	return s.register(name, &handler{
+		fn: func(_ context.Context, req *Request) (uint16, []byte, error) {
+			status, err := r(req.Payload, req.w)
+			return status, nil, err
+		},
+		mw:     mw,
+		stream: true})
+}
+
+// Use adds Middleware which applies to every handler on the
+// Server. Middleware is applied in the order it was added, with the
+// first being the outermost. Like Register, Use should be called
+// before clients begin sending requests.
+func (s *Server) Use(mw ...Middleware) {
+	s.mw = append(s.mw, mw...)
+}
+
+// chain returns h's func wrapped in its own middleware, and then the
+// Server's
+func (s *Server) chain(h *handler) HandlerCtx {
+	fn := h.fn
+	for i := len(h.mw) - 1; i >= 0; i-- {
+		fn = h.mw[i](fn)
+	}
+	for i := len(s.mw) - 1; i >= 0; i-- {
+		fn = s.mw[i](fn)
+	}
+	return fn
+}
+
+// Recover is a Middleware which traps panics in the handlers it
+// wraps, so that a misbehaving handler cannot crash the Server. The
+// request fails as if the handler had returned an error, with the
+// panic value as the error.
+func Recover(next HandlerCtx) HandlerCtx {
+	return func(ctx context.Context, req *Request) (status uint16, resp []byte, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				status, resp, err = 500, nil, fmt.Errorf("handler panic: %v", r)
+			}
+		}()
+		return next(ctx, req)
+	}
+}
+
+// register adds an entry to the dispatch table
+func (s *Server) register(name string, h *handler) error {
 	if _, ok := s.d[name]; ok {
 		return fmt.Errorf("handler '%s' already exists", name)
 	}
-	s.d[name] = r
+	s.d[name] = h
 	return nil
 }
 
+// ConnIds returns the ids of all connections currently open on the
+// Server.
+func (s *Server) ConnIds() []string {
+	ids := []string{}
+	s.cl.Range(func(k, v any) bool {
+		ids = append(ids, k.(string))
+		return true
+	})
+	return ids
+}
+
+// Push sends an unsolicited message to the client on the connection
+// with the given id. 'name' is sent in place of a request name, so
+// that the client can tell different kinds of pushes apart, and
+// 'payload' is the message body.
+func (s *Server) Push(id, name string, payload []byte) error {
+	v, ok := s.cl.Load(id)
+	if !ok {
+		return fmt.Errorf("no such connection '%s'", id)
+	}
+	return s.push(v.(*p.Conn), 200, name, payload)
+}
+
+// Broadcast sends an unsolicited message to every client connected
+// to the Server. It returns the number of clients which the message
+// was successfully sent to.
+func (s *Server) Broadcast(name string, payload []byte) int {
+	n := 0
+	s.cl.Range(func(k, v any) bool {
+		if s.push(v.(*p.Conn), 200, name, payload) == nil {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// push does the work of Push and Broadcast
+func (s *Server) push(c *p.Conn, status uint16, name string, payload []byte) error {
+	if len(name) > 255 {
+		return fmt.Errorf("invalid push: '%s' > 255 bytes", name)
+	}
+	err := p.ConnSend(c, &p.Resp{Status: status, Flags: p.FlagPush,
+		Req: name, Payload: payload})
+	code := uint16(102)
+	if status != 200 {
+		code = status
+	}
+	if err != nil {
+		code = p.WriteStatus(err)
+	}
+	s.Msgr <- &p.Msg{Cid: c.Sid, Req: name, Code: code,
+		Txt: p.Stats[code].Txt, Err: err}
+	return err
+}
+
 // Quit handles shutdown and cleanup, including waiting for any
 // connections to terminate. When it returns, all connections are
 // fully shut down and no more work will be done.
 func (s *Server) Quit() {
-	s.q <- true     // send true to quit chan
-	_ = s.l.Close() // close listener
-	s.w.Wait()      // wait for waitgroup to turn down
-	close(s.q)
-	close(s.Msgr)
+	s.stop()   // stop accepting connections
+	s.cancel() // cancel handler contexts
+	s.w.Wait() // wait for waitgroup to turn down
+	s.finish()
+}
+
+// GracefulQuit shuts down the Server, letting in-flight requests
+// finish first. It stops accepting new connections, then tells every
+// connected client that the Server is going away (status 197, sent as
+// a push). No further requests are read, but requests which are
+// already being handled are allowed to finish and send their
+// responses, after which each connection is closed.
+//
+// If ctx is done before all connections have closed, the remaining
+// connections are closed forcibly and their handlers' contexts are
+// cancelled. GracefulQuit then returns the number of connections
+// which were cut off, along with ctx's error. In that case, handlers
+// which ignore their contexts may still be running, and Server.Msgr
+// is left open until they have returned.
+func (s *Server) GracefulQuit(ctx context.Context) (int, error) {
+	s.dr.Store(true)
+	s.stop()
+	s.cl.Range(func(k, v any) bool {
+		_ = s.push(v.(*p.Conn), 197, "GOAWAY", nil)
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.w.Wait()
+		close(done)
+	}()
+	// wake each connServer from its read so that it can wind the
+	// connection down. a connServer which was about to begin a
+	// read sets its own deadline, so this is repeated until all
+	// of them have gone
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for draining := true; draining; {
+		s.cl.Range(func(k, v any) bool {
+			_ = v.(*p.Conn).NC.SetReadDeadline(time.Now())
+			return true
+		})
+		select {
+		case <-done:
+			s.cancel()
+			s.finish()
+			return 0, nil
+		case <-ctx.Done():
+			draining = false
+		case <-tick.C:
+		}
+	}
+
+	// out of time
+	s.cancel()
+	cut := 0
+	s.cl.Range(func(k, v any) bool {
+		_ = v.(*p.Conn).NC.Close()
+		cut++
+		return true
+	})
+	go func() {
+		<-done
+		s.finish()
+	}()
+	return cut, ctx.Err()
+}
+
+// stop closes the listener socket, once
+func (s *Server) stop() {
+	s.so.Do(func() {
+		s.q <- true     // send true to quit chan
+		_ = s.l.Close() // close listener
+	})
+}
+
+// finish releases the Server's channels, once, after all its
+// goroutines have exited
+func (s *Server) finish() {
+	s.fo.Do(func() {
+		close(s.q)
+		close(s.Msgr)
+	})
 }
 
 // msgHandler is a function which we'll launch later on as a
 // goroutine. It listens to our Server's Msgr channel, checking for a
-// few critical things and logging everything else informationally.
+// few critical things and logging everything else
+// informationally. It runs until Msgr is closed, so that connections
+// which are winding down after a shutdown has begun still have
+// their Msgs logged.
 func msgHandler(s *Server) {
-	keepalive := true
-	for keepalive {
-		msg := <-s.Msgr
+	for msg := range s.Msgr {
+		s.met.status(msg.Code)
 		switch msg.Code {
 		case 599:
 			// 599 is "the Server listener socket has
-			// died". call s.Quit() to clean things up,
-			// send the Msg to our main routine, then kill
-			// this loop
+			// died". send the Msg to our main routine,
+			// and call s.Quit() to clean things up. Quit
+			// waits on connections which may need to send
+			// Msgs, so it can't be called from here
 			s.Shutdown <- msg
-			keepalive = false
-			s.Quit()
+			go s.Quit()
 		case 199:
-			// 199 is "we've been told to quit", so we
-			// want to break out of the loop here as well
+			// 199 is "we've been told to quit"
 			s.Shutdown <- msg
-			keepalive = false
 		default:
 			// anything else we'll log
 			if msg.Code <= 1024 {
@@ -240,10 +714,84 @@ func msgHandler(s *Server) {
 	}
 }
 
-// protocheck implements the mandatory protocol check handler
-func protocheck(proto []byte) (uint16, []byte, error) {
-	if proto[0] == p.Proto[0] {
-		return 200, p.Proto, nil
+// protocheck implements the mandatory protocol check handler. Its
+// payload is the client's protocol version, optionally followed by
+// JSON-encoded Credentials. If the Server has an Authenticator, it is
+// consulted once the protocol version checks out. If not, the
+// connection's identity is taken from its TLS client certificate.
+func (s *Server) protocheck(_ context.Context, req *Request) (uint16, []byte, error) {
+	if len(req.Payload) == 0 || req.Payload[0] != p.Proto[0] {
+		return 497, p.Proto, nil
+	}
+	// without an Authenticator, a TLS client certificate (if
+	// there is one) is the connection's identity
+	ident := tlsIdentity(req.TLS)
+	hello, herr := parseHello(req.Payload)
+	if s.auth != nil {
+		if herr != nil {
+			s.Msgr <- &p.Msg{Cid: req.Sid, Seq: req.Seq, Req: req.Name,
+				Code: 496, Txt: "bad credentials", Err: herr}
+			return 496, p.Proto, nil
+		}
+		var err error
+		ident, err = s.auth(&hello.Credentials, req)
+		if err != nil || ident == nil {
+			if err != nil {
+				s.Msgr <- &p.Msg{Cid: req.Sid, Seq: req.Seq, Req: req.Name,
+					Code: 496, Txt: "rejected by authenticator", Err: err}
+			}
+			return 496, p.Proto, nil
+		}
+	}
+	if why := s.lim.admitIdent(req.conn, ident); why != "" {
+		s.Msgr <- &p.Msg{Cid: req.Sid, Seq: req.Seq, Req: req.Name,
+			Code: 495, Txt: fmt.Sprintf("%s: %s", p.Stats[495].Txt, why)}
+		return 495, []byte(why), nil
+	}
+	req.conn.Ident = ident
+	// the reply names the Compressor chosen for the connection,
+	// if there is one. connServer puts it into use once the
+	// reply has been sent
+	reply := append([]byte{}, p.Proto...)
+	if comp := s.compressor(hello); comp != nil {
+		reply = append(reply, comp.Name()...)
 	}
-	return 497, p.Proto, nil
+	return 200, reply, nil
+}
+
+// parseHello parses the body of a PROTOCHECK request. A request
+// with no body is an empty Hello.
+func parseHello(payload []byte) (*p.Hello, error) {
+	hello := &p.Hello{}
+	if len(payload) < 2 {
+		return hello, nil
+	}
+	if err := json.Unmarshal(payload[1:], hello); err != nil {
+		return &p.Hello{}, err
+	}
+	return hello, nil
+}
+
+// compressor returns the Compressor to be used on a connection: the
+// first one the client asked for which the Server allows, and which
+// is registered. It returns nil if there is none.
+func (s *Server) compressor(hello *p.Hello) p.Compressor {
+	for _, name := range hello.Compress {
+		if slices.Contains(s.comp, name) {
+			if comp := p.GetCompressor(name); comp != nil {
+				return comp
+			}
+		}
+	}
+	return nil
+}
+
+// ping implements the PING handler, which every Server answers. Its
+// response payload is the Server's clock, as Unix nanoseconds in
+// little-endian order, so that clients can measure clock skew as
+// well as round-trip time.
+func ping(_ []byte) (uint16, []byte, error) {
+	now := make([]byte, 8)
+	binary.LittleEndian.PutUint64(now, uint64(time.Now().UnixNano()))
+	return 200, now, nil
 }
@@ -1,12 +1,30 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	//	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	p "github.com/firepear/petrel"
 	pc "github.com/firepear/petrel/client"
 )
 
@@ -119,6 +137,933 @@ func TestServerSmallPayload(t *testing.T) {
 	s.Quit()
 }
 
+// check that a HandlerCtx gets request and connection info, and that
+// its context is cancelled when the client goes away
+func TestServerHandlerCtx(t *testing.T) {
+	s, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	if err = s.RegisterCtx("whoami", whoamiHandler); err != nil {
+		t.Errorf("%s: couldn't register: %s", t.Name(), err)
+	}
+	cancelled := make(chan bool, 1)
+	_ = s.RegisterCtx("block", func(ctx context.Context, r *Request) (uint16, []byte, error) {
+		select {
+		case <-ctx.Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+		return 200, nil, nil
+	})
+
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	err = cc.Dispatch("whoami", []byte("foo"))
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	ids := s.ConnIds()
+	want := fmt.Sprintf("%s whoami 2 foo tcp", ids[0])
+	if string(cc.Resp.Payload) != want {
+		t.Errorf("%s: got '%s', want '%s'", t.Name(), cc.Resp.Payload, want)
+	}
+
+	// start a request which blocks until its context is done,
+	// then drop the connection
+	_, err = cc.DispatchAsync("block", nil)
+	if err != nil {
+		t.Errorf("%s: dispatch failed: %s", t.Name(), err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	cc.Quit()
+	if !<-cancelled {
+		t.Errorf("%s: handler context was not cancelled", t.Name())
+	}
+}
+
+// check server-wide and per-handler middleware, including
+// short-circuiting and panic recovery
+func TestServerMiddleware(t *testing.T) {
+	s, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+
+	// a server-wide middleware which counts requests, and one
+	// which recovers from panics
+	var count atomic.Int32
+	s.Use(func(next HandlerCtx) HandlerCtx {
+		return func(ctx context.Context, r *Request) (uint16, []byte, error) {
+			count.Add(1)
+			return next(ctx, r)
+		}
+	}, Recover)
+	// a per-handler middleware which refuses some payloads
+	deny := func(next HandlerCtx) HandlerCtx {
+		return func(ctx context.Context, r *Request) (uint16, []byte, error) {
+			if string(r.Payload) == "deny" {
+				return 9000, []byte("denied"), nil
+			}
+			return next(ctx, r)
+		}
+	}
+	_ = s.Register("echo", echoHandler, deny)
+	_ = s.Register("panic", func([]byte) (uint16, []byte, error) {
+		panic("oh no")
+	})
+
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Errorf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+	_ = cc.Dispatch("echo", []byte("hi"))
+	if cc.Resp.Status != 200 || string(cc.Resp.Payload) != "hi" {
+		t.Errorf("%s: bad echo: %d %s", t.Name(), cc.Resp.Status, cc.Resp.Payload)
+	}
+	_ = cc.Dispatch("echo", []byte("deny"))
+	if cc.Resp.Status != 9000 || string(cc.Resp.Payload) != "denied" {
+		t.Errorf("%s: should be denied: %d %s", t.Name(), cc.Resp.Status, cc.Resp.Payload)
+	}
+	// PROTOCHECK passes through middleware too
+	if n := count.Load(); n != 3 {
+		t.Errorf("%s: should have counted 3 requests, got %d", t.Name(), n)
+	}
+	// the panic is trapped; the server reports an error
+	_ = cc.Dispatch("panic", nil)
+	if cc.Resp.Status != 500 {
+		t.Errorf("%s: panic should give 500, got %d", t.Name(), cc.Resp.Status)
+	}
+}
+
+// check that ACLs let in only the right identities
+func TestServerACL(t *testing.T) {
+	s, err := New(&Config{Addr: sn, Authenticator: groupAuth})
+	if err != nil {
+		t.Errorf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("admin", echoHandler, Allow(ACL{Groups: []string{"admin"}}))
+	_ = s.Register("bobonly", echoHandler, Allow(ACL{Names: []string{"bob"}}))
+	_ = s.Register("open", echoHandler)
+
+	tests := []struct {
+		user   string
+		req    string
+		status uint16
+	}{
+		{"alice", "admin", 200},
+		{"alice", "bobonly", 403},
+		{"alice", "open", 200},
+		{"bob", "admin", 403},
+		{"bob", "bobonly", 200},
+		{"bob", "open", 200},
+	}
+	for _, test := range tests {
+		cc, err := pc.New(&pc.Config{Addr: sn,
+			Credentials: &p.Credentials{User: test.user}})
+		if err != nil {
+			t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+		}
+		_ = cc.Dispatch(test.req, []byte("x"))
+		if cc.Resp.Status != test.status {
+			t.Errorf("%s: %s %s: want %d got %d", t.Name(), test.user,
+				test.req, test.status, cc.Resp.Status)
+		}
+		// a forbidden request doesn't close the connection
+		err = cc.Dispatch("open", []byte("x"))
+		if err != nil || cc.Resp.Status != 200 {
+			t.Errorf("%s: conn unusable after %s: %s", t.Name(), test.req, err)
+		}
+		cc.Quit()
+	}
+
+	// ACLs never permit connections with no identity
+	if (ACL{Names: []string{""}}).Permits(nil) {
+		t.Errorf("%s: nil identity permitted", t.Name())
+	}
+}
+
+// check identities taken from TLS client certs
+func TestServerTLSIdentity(t *testing.T) {
+	if tlsIdentity(nil) != nil || tlsIdentity(&tls.ConnectionState{}) != nil {
+		t.Errorf("%s: identity from no cert", t.Name())
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "carol",
+		OrganizationalUnit: []string{"ops", "admin"}}}
+	ident := tlsIdentity(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert}})
+	if ident.Name != "carol" || len(ident.Groups) != 2 || ident.Groups[1] != "admin" {
+		t.Errorf("%s: bad identity: %v", t.Name(), ident)
+	}
+}
+
+// serve over a unix domain socket, including cleaning up a stale
+// socket file and setting permissions
+func TestServerUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "petrel.sock")
+
+	// leave a stale socket file behind
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatalf("%s: couldn't make stale socket: %s", t.Name(), err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+
+	s, err := New(&Config{Addr: sock, Network: "unix", SockMode: 0600})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	_ = s.Register("echo", echoHandler)
+	fi, err := os.Stat(sock)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("%s: bad socket perms: %s %v", t.Name(), err, fi.Mode())
+	}
+
+	// a second server can't steal a live socket
+	if _, err = New(&Config{Addr: sock, Network: "unix"}); err == nil {
+		t.Errorf("%s: second server should have failed", t.Name())
+	}
+
+	cc, err := pc.New(&pc.Config{Addr: sock, Network: "unix"})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	err = cc.Dispatch("echo", []byte("hi"))
+	if err != nil || string(cc.Resp.Payload) != "hi" {
+		t.Errorf("%s: bad echo: %s %s", t.Name(), err, cc.Resp.Payload)
+	}
+	cc.Quit()
+	for lenSyncMap(s.cl) > 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	s.Quit()
+
+	// and the socket file is removed on Quit
+	if _, err = os.Stat(sock); err == nil {
+		t.Errorf("%s: socket file not removed", t.Name())
+	}
+}
+
+// serve over a linux abstract socket
+func TestServerAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are linux-only")
+	}
+	sock := fmt.Sprintf("@petrel-test-%d", os.Getpid())
+	s, err := New(&Config{Addr: sock, Network: "unix"})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	_ = s.Register("echo", echoHandler)
+	cc, err := pc.New(&pc.Config{Addr: sock, Network: "unix"})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	err = cc.Dispatch("echo", []byte("hi"))
+	if err != nil || string(cc.Resp.Payload) != "hi" {
+		t.Errorf("%s: bad echo: %s %s", t.Name(), err, cc.Resp.Payload)
+	}
+	cc.Quit()
+	for lenSyncMap(s.cl) > 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	s.Quit()
+}
+
+// connection limits, global and per identity
+func TestServerConnLimits(t *testing.T) {
+	s, err := New(&Config{Addr: sn, Authenticator: groupAuth,
+		MaxConns: 2, MaxConnsPerIdent: 1})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+
+	alice, err := pc.New(&pc.Config{Addr: sn,
+		Credentials: &p.Credentials{User: "alice"}})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	// alice is already connected
+	_, err = pc.New(&pc.Config{Addr: sn,
+		Credentials: &p.Credentials{User: "alice"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "[495]") {
+		t.Errorf("%s: second alice should be over limit: %s", t.Name(), err)
+	}
+	bob, err := pc.New(&pc.Config{Addr: sn,
+		Credentials: &p.Credentials{User: "bob"}})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	cnt := s.ConnCounts()
+	if cnt.Total != 2 || cnt.ByIP["127.0.0.1"] != 2 ||
+		cnt.ByIdent["alice"] != 1 || cnt.ByIdent["bob"] != 1 {
+		t.Errorf("%s: bad counts: %+v", t.Name(), cnt)
+	}
+	// and now the server is full
+	_, err = pc.New(&pc.Config{Addr: sn,
+		Credentials: &p.Credentials{User: "bob"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "[495]") {
+		t.Errorf("%s: third conn should be over limit: %s", t.Name(), err)
+	}
+
+	// closing a conn makes room
+	alice.Quit()
+	time.Sleep(25 * time.Millisecond)
+	if cnt = s.ConnCounts(); cnt.Total != 1 || cnt.ByIdent["alice"] != 0 {
+		t.Errorf("%s: bad counts after quit: %+v", t.Name(), cnt)
+	}
+	alice, err = pc.New(&pc.Config{Addr: sn,
+		Credentials: &p.Credentials{User: "alice"}})
+	if err != nil {
+		t.Errorf("%s: alice should fit now: %s", t.Name(), err)
+	} else {
+		alice.Quit()
+	}
+	bob.Quit()
+}
+
+// connection limit per remote IP
+func TestServerConnLimitIP(t *testing.T) {
+	s, err := New(&Config{Addr: sn, MaxConnsPerIP: 1})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	c1, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer c1.Quit()
+	_, err = pc.New(&pc.Config{Addr: sn})
+	if err == nil || !strings.HasPrefix(err.Error(), "[495]") {
+		t.Errorf("%s: second conn should be over limit: %s", t.Name(), err)
+	}
+}
+
+// a rejected conn which sends nothing is closed after rejectWait,
+// however long the network timeouts are
+func TestServerConnLimitIdle(t *testing.T) {
+	s, err := New(&Config{Addr: sn, MaxConns: 1, IdleTimeout: 5000, MinRate: 1})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	c1, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer c1.Quit()
+	nc, err := net.Dial("tcp", sn)
+	if err != nil {
+		t.Fatalf("%s: couldn't dial: %s", t.Name(), err)
+	}
+	defer nc.Close()
+	start := time.Now()
+	_ = nc.SetReadDeadline(start.Add(3 * time.Second))
+	if _, err = nc.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%s: conn should have been closed: %v", t.Name(), err)
+	}
+	if el := time.Since(start); el > rejectWait+500*time.Millisecond {
+		t.Errorf("%s: rejected conn was held for %s", t.Name(), el)
+	}
+}
+
+// rejected conns beyond maxRejects are closed without waiting
+func TestServerConnLimitRejects(t *testing.T) {
+	defer func(n int) { maxRejects = n }(maxRejects)
+	maxRejects = 1
+	s, err := New(&Config{Addr: sn, MaxConns: 1})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	c1, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer c1.Quit()
+	// the first rejected conn waits for its PROTOCHECK
+	nc1, err := net.Dial("tcp", sn)
+	if err != nil {
+		t.Fatalf("%s: couldn't dial: %s", t.Name(), err)
+	}
+	defer nc1.Close()
+	// and the second is closed right away
+	nc2, err := net.Dial("tcp", sn)
+	if err != nil {
+		t.Fatalf("%s: couldn't dial: %s", t.Name(), err)
+	}
+	defer nc2.Close()
+	start := time.Now()
+	_ = nc2.SetReadDeadline(start.Add(3 * time.Second))
+	if _, err = nc2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%s: conn should have been closed: %v", t.Name(), err)
+	}
+	if el := time.Since(start); el > rejectWait/2 {
+		t.Errorf("%s: second rejected conn was held for %s", t.Name(), el)
+	}
+	_ = nc1.SetReadDeadline(start.Add(3 * time.Second))
+	if _, err = nc1.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%s: conn should have been closed: %v", t.Name(), err)
+	}
+	if el := time.Since(start); el < rejectWait/2 {
+		t.Errorf("%s: first rejected conn was closed after %s", t.Name(), el)
+	}
+}
+
+// rate limits per connection, per IP, and per handler
+func TestServerRateLimit(t *testing.T) {
+	s, err := New(&Config{Addr: sn, ConnRate: Rate{Limit: 10, Burst: 2},
+		IPRate: Rate{Limit: 10, Burst: 3}})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("echo", echoHandler)
+	_ = s.Register("once", echoHandler, RateLimit(Rate{Limit: 0.1}))
+
+	c1, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer c1.Quit()
+	c2, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer c2.Quit()
+
+	// c1 uses its burst, and is limited
+	for i := 0; i < 2; i++ {
+		if err = c1.Dispatch("echo", []byte("x")); err != nil {
+			t.Errorf("%s: request %d should work: %s", t.Name(), i, err)
+		}
+	}
+	err = c1.Dispatch("echo", []byte("x"))
+	var rl *pc.RateLimitError
+	if !errors.As(err, &rl) || c1.Resp.Status != 429 {
+		t.Fatalf("%s: should be rate limited: %s %d", t.Name(), err, c1.Resp.Status)
+	}
+	if rl.RetryAfter <= 0 || rl.RetryAfter > 100*time.Millisecond {
+		t.Errorf("%s: bad retry hint: %s", t.Name(), rl.RetryAfter)
+	}
+	if c1.Closed() {
+		t.Errorf("%s: client should still be open", t.Name())
+	}
+	// c2 has its own conn bucket, but shares the IP bucket, which
+	// c1 has already drained most of
+	if err = c2.Dispatch("echo", []byte("x")); err != nil {
+		t.Errorf("%s: c2 should get the last ip token: %s", t.Name(), err)
+	}
+	if err = c2.Dispatch("echo", []byte("x")); !errors.As(err, &rl) {
+		t.Errorf("%s: c2 should be limited by ip: %s", t.Name(), err)
+	}
+	// after waiting, requests work again
+	time.Sleep(rl.RetryAfter)
+	if err = c1.Dispatch("echo", []byte("x")); err != nil {
+		t.Errorf("%s: request after wait should work: %s", t.Name(), err)
+	}
+
+	// the handler limit applies across connections. wait for
+	// the other buckets to refill first
+	time.Sleep(300 * time.Millisecond)
+	if err = c1.Dispatch("once", []byte("x")); err != nil {
+		t.Errorf("%s: first 'once' should work: %s", t.Name(), err)
+	}
+	if err = c2.Dispatch("once", []byte("x")); !errors.As(err, &rl) {
+		t.Errorf("%s: second 'once' should be limited: %s", t.Name(), err)
+	}
+	if rl.RetryAfter < 9*time.Second {
+		t.Errorf("%s: bad retry hint: %s", t.Name(), rl.RetryAfter)
+	}
+}
+
+// a request refused by one limit does not use up the other
+func TestServerThrottle(t *testing.T) {
+	s := &Server{ipb: &ipBuckets{rate: Rate{Limit: 0.01, Burst: 1},
+		b: map[string]*bucket{}}}
+	cb := newBucket(Rate{Limit: 0.01, Burst: 2})
+	if wait := s.throttle("1.2.3.4", cb); wait != 0 {
+		t.Errorf("%s: first request should pass: %s", t.Name(), wait)
+	}
+	// the IP bucket is empty, so the conn bucket keeps its token
+	if wait := s.throttle("1.2.3.4", cb); wait == 0 {
+		t.Errorf("%s: second request should be limited by IP", t.Name())
+	}
+	if wait := s.throttle("5.6.7.8", cb); wait != 0 {
+		t.Errorf("%s: conn bucket should still have a token: %s", t.Name(), wait)
+	}
+	if wait := s.throttle("9.9.9.9", cb); wait == 0 {
+		t.Errorf("%s: conn bucket should now be empty", t.Name())
+	}
+	// and an IP refused by the conn limit keeps its token
+	if wait := s.throttle("9.9.9.9", nil); wait != 0 {
+		t.Errorf("%s: IP bucket should still have a token: %s", t.Name(), wait)
+	}
+}
+
+// requests over a connection's in-flight limit are refused
+func TestServerMaxInFlight(t *testing.T) {
+	s, err := New(&Config{Addr: sn, MaxInFlight: 2})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("sleep", sleepHandler)
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+
+	calls := []*pc.Call{}
+	for range 4 {
+		call, err := cc.DispatchAsync("sleep", []byte("50"))
+		if err != nil {
+			t.Fatalf("%s: couldn't dispatch: %s", t.Name(), err)
+		}
+		calls = append(calls, call)
+	}
+	ok, refused := 0, 0
+	for _, call := range calls {
+		resp, _ := call.Wait()
+		switch resp.Status {
+		case 200:
+			ok++
+		case 430:
+			refused++
+		}
+	}
+	if ok != 2 || refused != 2 {
+		t.Errorf("%s: want 2 ok and 2 refused, got %d and %d", t.Name(), ok, refused)
+	}
+	// the connection stays open, and the slots are given back
+	if err = cc.Dispatch("sleep", []byte("1")); err != nil || cc.Resp.Status != 200 {
+		t.Errorf("%s: request after limit should work: %s %d", t.Name(), err, cc.Resp.Status)
+	}
+}
+
+// idle and handler timeouts
+func TestServerTimeouts(t *testing.T) {
+	s, err := New(&Config{Addr: sn, IdleTimeout: 50, HandlerTimeout: 30})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("sleep", sleepHandler)
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+
+	// a slow handler times out, but the conn stays open
+	err = cc.Dispatch("sleep", []byte("100"))
+	if err != nil || cc.Resp.Status != 494 {
+		t.Errorf("%s: should have gotten 494: %s %d", t.Name(), err, cc.Resp.Status)
+	}
+	if err = cc.Dispatch("sleep", []byte("1")); err != nil || cc.Resp.Status != 200 {
+		t.Errorf("%s: fast request should work: %s %d", t.Name(), err, cc.Resp.Status)
+	}
+	// idling gets the conn closed
+	time.Sleep(100 * time.Millisecond)
+	if !cc.Closed() {
+		t.Errorf("%s: client should have been idled out", t.Name())
+	}
+	if err = cc.Dispatch("sleep", []byte("1")); err == nil || !strings.Contains(err.Error(), "490") {
+		t.Errorf("%s: should have gotten a 490 error: %s", t.Name(), err)
+	}
+}
+
+// a stream cut off by HandlerTimeout sends nothing after its end
+func TestServerStreamTimeout(t *testing.T) {
+	s, err := New(&Config{Addr: sn, HandlerTimeout: 20})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.RegisterStream("flood", func(_ []byte, w io.Writer) (uint16, error) {
+		for {
+			if _, err := w.Write([]byte("x")); err != nil {
+				return 200, nil
+			}
+		}
+	})
+	nc, err := net.Dial("tcp", sn)
+	if err != nil {
+		t.Fatalf("%s: couldn't dial: %s", t.Name(), err)
+	}
+	defer nc.Close()
+	// request "flood", seq 1, no payload
+	_, _ = nc.Write(append([]byte{0, 0, 1, 0, 0, 0, 0, 5, 0, 0, 0, 0}, "flood"...))
+
+	eos := false
+	hdr := make([]byte, 12)
+	for {
+		_ = nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := io.ReadFull(nc, hdr); err != nil {
+			break
+		}
+		n := int(hdr[7]) + int(binary.LittleEndian.Uint32(hdr[8:]))
+		if _, err := io.ReadFull(nc, make([]byte, n)); err != nil {
+			break
+		}
+		if eos {
+			t.Fatalf("%s: got a transmission after end of stream: %v", t.Name(), hdr)
+		}
+		if hdr[6]&p.FlagEOS != 0 {
+			eos = true
+			if st := binary.LittleEndian.Uint16(hdr); st != 494 {
+				t.Errorf("%s: stream should end with 494, got %d", t.Name(), st)
+			}
+		}
+	}
+	if !eos {
+		t.Errorf("%s: stream never ended", t.Name())
+	}
+}
+
+// a second PROTOCHECK on a connection is refused, and the
+// connection closed
+func TestServerRepeatProtocheck(t *testing.T) {
+	s, err := New(&Config{Addr: sn, Authenticator: groupAuth})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	nc, err := net.Dial("tcp", sn)
+	if err != nil {
+		t.Fatalf("%s: couldn't dial: %s", t.Name(), err)
+	}
+	defer nc.Close()
+	_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+
+	hello := append([]byte{1}, `{"user":"bob"}`...)
+	check := func(seq byte, payload []byte) uint16 {
+		xm := []byte{0, 0, seq, 0, 0, 0, 0, 10, byte(len(payload)), 0, 0, 0}
+		xm = append(append(xm, "PROTOCHECK"...), payload...)
+		_, _ = nc.Write(xm)
+		hdr := make([]byte, 12)
+		if _, err := io.ReadFull(nc, hdr); err != nil {
+			return 0
+		}
+		n := int(hdr[7]) + int(binary.LittleEndian.Uint32(hdr[8:]))
+		_, _ = io.ReadFull(nc, make([]byte, n))
+		return binary.LittleEndian.Uint16(hdr)
+	}
+	if st := check(1, hello); st != 200 {
+		t.Fatalf("%s: handshake should work, got %d", t.Name(), st)
+	}
+	// alice can't take over bob's connection
+	if st := check(2, append([]byte{1}, `{"user":"alice"}`...)); st != 497 {
+		t.Errorf("%s: second handshake should get 497, got %d", t.Name(), st)
+	}
+	if _, err = nc.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%s: connection should be closed: %v", t.Name(), err)
+	}
+}
+
+// header and payload read timeouts, against a raw connection
+func TestServerReadTimeouts(t *testing.T) {
+	s, err := New(&Config{Addr: sn, HeaderTimeout: 30, PayloadTimeout: 30,
+		MinRate: 1000})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+
+	// hdr is the header for a request named "x" with a 100
+	// byte payload
+	hdr := []byte{0, 0, 1, 0, 0, 0, 0, 1, 100, 0, 0, 0}
+	tests := []struct {
+		name   string
+		send   []byte
+		status uint16
+	}{
+		{"header", hdr[:4], 491},
+		{"payload", append(hdr, 'x', 'p'), 492},
+	}
+	for _, test := range tests {
+		nc, err := net.Dial("tcp", sn)
+		if err != nil {
+			t.Fatalf("%s: couldn't dial: %s", t.Name(), err)
+		}
+		start := time.Now()
+		_, _ = nc.Write(test.send)
+		// the server answers with the status, then hangs up
+		resp, _ := io.ReadAll(nc)
+		nc.Close()
+		if len(resp) < 2 || binary.LittleEndian.Uint16(resp) != test.status {
+			t.Errorf("%s: %s: want %d, got %v", t.Name(), test.name, test.status, resp)
+		}
+		// the payload deadline is 30ms plus 100ms for 100 bytes
+		// at MinRate
+		el := time.Since(start)
+		if test.name == "payload" && (el < 120*time.Millisecond || el > time.Second) {
+			t.Errorf("%s: payload timeout took %s", t.Name(), el)
+		}
+	}
+}
+
+// HMAC-signed transmissions
+func TestServerHMAC(t *testing.T) {
+	key := []byte("sekrit")
+	s, err := New(&Config{Addr: sn, HMACKey: key})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("echo", echoHandler)
+	cc, err := pc.New(&pc.Config{Addr: sn, HMACKey: key})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	err = cc.Dispatch("echo", []byte("signed"))
+	if err != nil || string(cc.Resp.Payload) != "signed" {
+		t.Errorf("%s: signed echo failed: %s %v", t.Name(), err, cc.Resp)
+	}
+	cc.Quit()
+	// a client with the wrong key is rejected
+	_, err = pc.New(&pc.Config{Addr: sn, HMACKey: []byte("wrong")})
+	if err == nil {
+		t.Errorf("%s: client with wrong key should fail", t.Name())
+	}
+}
+
+// introspection handlers
+func TestServerIntrospect(t *testing.T) {
+	s, err := New(&Config{Addr: sn, MaxConns: 10, HandlerTimeout: 500})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("echo", echoHandler)
+	if err = s.Describe("echo", "echoes its payload"); err != nil {
+		t.Errorf("%s: describe failed: %s", t.Name(), err)
+	}
+	if err = s.Describe("nope", "nothing"); err == nil {
+		t.Errorf("%s: describing a missing handler should fail", t.Name())
+	}
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+
+	// not registered until asked for
+	_ = cc.Dispatch("PETREL.INFO", nil)
+	if cc.Resp.Status != 400 {
+		t.Errorf("%s: introspection should be opt-in: %d", t.Name(), cc.Resp.Status)
+	}
+	if err = s.Introspect(); err != nil {
+		t.Fatalf("%s: introspect failed: %s", t.Name(), err)
+	}
+
+	var hi []HandlerInfo
+	_ = cc.Dispatch("PETREL.HANDLERS", nil)
+	if err = json.Unmarshal(cc.Resp.Payload, &hi); err != nil {
+		t.Fatalf("%s: bad HANDLERS: %s", t.Name(), err)
+	}
+	names := []string{}
+	for _, h := range hi {
+		names = append(names, h.Name)
+		if h.Name == "echo" && h.Desc != "echoes its payload" {
+			t.Errorf("%s: bad echo desc: %s", t.Name(), h.Desc)
+		}
+	}
+	want := "[PETREL.HANDLERS PETREL.INFO PETREL.STATUS PING PROTOCHECK echo]"
+	if fmt.Sprint(names) != want {
+		t.Errorf("%s: bad handler list: %v", t.Name(), names)
+	}
+
+	var si ServerInfo
+	_ = cc.Dispatch("PETREL.INFO", nil)
+	if err = json.Unmarshal(cc.Resp.Payload, &si); err != nil {
+		t.Fatalf("%s: bad INFO: %s", t.Name(), err)
+	}
+	if si.Sid != s.sid || si.Proto != int(p.Proto[0]) ||
+		si.Limits.MaxConns != 10 || si.Limits.HandlerTimeout != 500 {
+		t.Errorf("%s: bad info: %+v", t.Name(), si)
+	}
+
+	var st []StatusInfo
+	_ = cc.Dispatch("PETREL.STATUS", nil)
+	if err = json.Unmarshal(cc.Resp.Payload, &st); err != nil {
+		t.Fatalf("%s: bad STATUS: %s", t.Name(), err)
+	}
+	if len(st) != len(p.Stats) || st[0].Code != 100 {
+		t.Errorf("%s: bad status list: %v", t.Name(), st)
+	}
+}
+
+// metrics snapshots and exports
+func TestServerMetrics(t *testing.T) {
+	s, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("echo", echoHandler)
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+	for _, pl := range []string{"a", "bb", "ccc"} {
+		_ = cc.Dispatch("echo", []byte(pl))
+	}
+	_ = cc.Dispatch("nope", nil)
+
+	// metrics are recorded after the response is sent, so
+	// give the last one a moment
+	m := s.Metrics()
+	for i := 0; i < 100 && m.Handlers["echo"].Requests < 3; i++ {
+		time.Sleep(time.Millisecond)
+		m = s.Metrics()
+	}
+	echo := m.Handlers["echo"]
+	if echo.Requests != 3 || echo.Statuses[200] != 3 || echo.BytesIn != 6 ||
+		echo.BytesOut != 6 {
+		t.Errorf("%s: bad echo metrics: %+v", t.Name(), echo)
+	}
+	if echo.Latency.Count != 3 || echo.Latency.Counts[len(LatencyBuckets)-1] != 3 {
+		t.Errorf("%s: bad latency: %+v", t.Name(), echo.Latency)
+	}
+	if _, ok := m.Handlers["nope"]; ok {
+		t.Errorf("%s: unknown handlers should not have metrics", t.Name())
+	}
+	if m.Conns.Open != 1 || m.Conns.Accepted != 1 || m.Conns.Rejected != 0 {
+		t.Errorf("%s: bad conn metrics: %+v", t.Name(), m.Conns)
+	}
+	// statuses are counted as they're logged
+	for s.Metrics().Statuses[400] != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var b strings.Builder
+	if err = s.WritePrometheus(&b); err != nil {
+		t.Errorf("%s: WritePrometheus failed: %s", t.Name(), err)
+	}
+	sid := fmt.Sprintf(`sid="%s"`, s.sid)
+	for _, line := range []string{
+		"# TYPE petrel_request_duration_seconds histogram",
+		"petrel_connections_open{" + sid + "} 1",
+		"petrel_statuses_total{" + sid + `,status="400"} 1`,
+		"petrel_requests_total{" + sid + `,handler="echo",status="200"} 3`,
+		"petrel_request_bytes_total{" + sid + `,handler="echo"} 6`,
+		"petrel_request_duration_seconds_bucket{" + sid + `,handler="echo",le="+Inf"} 3`,
+		"petrel_request_duration_seconds_count{" + sid + `,handler="echo"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("%s: prometheus output lacks %q", t.Name(), line)
+		}
+	}
+
+	s.PublishExpvar("petrel_" + s.sid)
+	if v := expvar.Get("petrel_" + s.sid); v == nil || !strings.Contains(v.String(), `"Requests":3`) {
+		t.Errorf("%s: bad expvar: %v", t.Name(), v)
+	}
+
+	// changing the buckets does not affect a running Server
+	lb := LatencyBuckets
+	defer func() { LatencyBuckets = lb }()
+	LatencyBuckets = make([]float64, 2*len(lb))
+	_ = cc.Dispatch("echo", []byte("d"))
+	for i := 0; i < 100 && s.Metrics().Handlers["echo"].Requests < 4; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if l := s.Metrics().Handlers["echo"].Latency; len(l.Buckets) != len(lb) ||
+		l.Counts[len(lb)-1] != 4 {
+		t.Errorf("%s: bad latency after bucket change: %+v", t.Name(), l)
+	}
+}
+
+// shut down gracefully, letting an in-flight request finish
+func TestServerGracefulQuit(t *testing.T) {
+	s, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	states := make(chan pc.State, 4)
+	cc, err := pc.New(&pc.Config{Addr: sn,
+		OnState: func(st pc.State) { states <- st }})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	<-states // connected
+	call, _ := cc.DispatchAsync("sleep", []byte("50"))
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	n, err := s.GracefulQuit(ctx)
+	if n != 0 || err != nil {
+		t.Errorf("%s: should have been clean: %d %s", t.Name(), n, err)
+	}
+	// the client was told, and its request still completed
+	if st := <-states; st != pc.StateGoingAway {
+		t.Errorf("%s: client should be going away, is %s", t.Name(), st)
+	}
+	push := <-cc.Push
+	if push.Status != 197 || push.Req != "GOAWAY" {
+		t.Errorf("%s: bad goaway: %v", t.Name(), push)
+	}
+	resp, err := call.Wait()
+	if err != nil || resp.Status != 200 || string(resp.Payload) != "50" {
+		t.Errorf("%s: in-flight request failed: %s %v", t.Name(), err, resp)
+	}
+	if err = cc.Dispatch("sleep", []byte("1")); err == nil {
+		t.Errorf("%s: dispatch after goaway should fail", t.Name())
+	}
+	cc.Quit()
+}
+
+// shut down with a deadline which a handler doesn't meet
+func TestServerGracefulQuitForced(t *testing.T) {
+	s, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	_ = s.Register("sleep", sleepHandler)
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	call, _ := cc.DispatchAsync("sleep", []byte("200"))
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	n, err := s.GracefulQuit(ctx)
+	if n != 1 || err != context.DeadlineExceeded {
+		t.Errorf("%s: should have cut 1 conn: %d %s", t.Name(), n, err)
+	}
+	if _, err = call.Wait(); err == nil {
+		t.Errorf("%s: in-flight request should have failed", t.Name())
+	}
+	cc.Quit()
+	// once the handler finishes, the Server is torn down
+	timeout := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-s.Msgr:
+			closed = !ok
+		case <-timeout:
+			t.Fatalf("%s: Msgr was never closed", t.Name())
+		}
+	}
+}
+
 /*////////////////////////////////////////////////////////////////////////
   // below this point are the functions used by tests
   ////////////////////////////////////////////////////////////////////////*/
@@ -148,3 +1093,426 @@ func lenSyncMap(m *sync.Map) int {
 func fakeHandler(r []byte) (uint16, []byte, error) {
 	return 0, []byte{}, fmt.Errorf("fake")
 }
+
+// whoamiHandler reports back on the request and its connection
+func whoamiHandler(ctx context.Context, r *Request) (uint16, []byte, error) {
+	return 200, []byte(fmt.Sprintf("%s %s %d %s %s", r.Id, r.Name, r.Seq,
+		r.Payload, r.RemoteAddr.Network())), nil
+}
+
+// echoHandler returns its payload
+func echoHandler(r []byte) (uint16, []byte, error) {
+	return 200, r, nil
+}
+
+// groupAuth is an Authenticator which knows two users: alice, who is
+// an admin, and bob, who is not
+func groupAuth(creds *p.Credentials, r *Request) (*p.Identity, error) {
+	switch creds.User {
+	case "alice":
+		return &p.Identity{Name: "alice", Groups: []string{"staff", "admin"}}, nil
+	case "bob":
+		return &p.Identity{Name: "bob", Groups: []string{"staff"}}, nil
+	}
+	return nil, nil
+}
+
+// sleepHandler sleeps for the number of milliseconds given in its
+// payload, then echoes the payload back
+func sleepHandler(r []byte) (uint16, []byte, error) {
+	ms, err := strconv.Atoi(string(r))
+	if err != nil {
+		return 0, nil, err
+	}
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return 200, r, nil
+}
+
+// spanRecorder is a Tracer which keeps the spans it is given
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []p.Span
+}
+
+func (sr *spanRecorder) SpanStart(*p.Span) {}
+
+func (sr *spanRecorder) SpanEnd(s *p.Span) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.spans = append(sr.spans, *s)
+}
+
+func (sr *spanRecorder) get(kind, name string) (p.Span, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for _, s := range sr.spans {
+		if s.Kind == kind && s.Name == name {
+			return s, true
+		}
+	}
+	return p.Span{}, false
+}
+
+// a trace started by a client should follow a request through a
+// server, and on through the requests its handler makes
+func TestServerTrace(t *testing.T) {
+	sn2 := "localhost:60607"
+	rec := &spanRecorder{}
+	back, err := New(&Config{Addr: sn2})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer back.Quit()
+	_ = back.RegisterCtx("echo", func(ctx context.Context, r *Request) (uint16, []byte, error) {
+		if _, ok := p.TraceFromContext(ctx); !ok || r.Trace.IsZero() {
+			return 500, nil, fmt.Errorf("no trace in backend handler")
+		}
+		return 200, r.Payload, nil
+	})
+	bc, err := pc.New(&pc.Config{Addr: sn2, Tracer: rec})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer bc.Quit()
+
+	front, err := New(&Config{Addr: sn, Tracer: rec})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer front.Quit()
+	_ = front.RegisterCtx("relay", func(ctx context.Context, r *Request) (uint16, []byte, error) {
+		call, err := bc.DispatchAsyncCtx(ctx, "echo", r.Payload)
+		if err != nil {
+			return 500, nil, err
+		}
+		resp, err := call.Wait()
+		if err != nil {
+			return 500, nil, err
+		}
+		return resp.Status, resp.Payload, nil
+	})
+	fc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer fc.Quit()
+
+	root := p.NewTrace()
+	ctx := p.ContextWithTrace(context.Background(), root)
+	if err = fc.DispatchCtx(ctx, "relay", []byte("hello")); err != nil {
+		t.Fatalf("%s: relay failed: %s", t.Name(), err)
+	}
+	if string(fc.Resp.Payload) != "hello" {
+		t.Errorf("%s: bad payload: %q", t.Name(), fc.Resp.Payload)
+	}
+
+	// the front client has no Tracer, but the trace still reaches
+	// the front server
+	fs, ok := rec.get("server", "relay")
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(time.Millisecond)
+		fs, ok = rec.get("server", "relay")
+	}
+	if !ok {
+		t.Fatalf("%s: no span for relay", t.Name())
+	}
+	bcs, ok := rec.get("client", "echo")
+	if !ok {
+		t.Fatalf("%s: no client span for echo", t.Name())
+	}
+	if fs.Trace != root.ID || bcs.Trace != root.ID {
+		t.Errorf("%s: spans not in the root trace: %s %s", t.Name(), fs.Trace, bcs.Trace)
+	}
+	if fs.Parent == root.Span || fs.Parent == (p.SpanID{}) {
+		// the front client made a span of its own, as a
+		// child of root, which the server's span is a
+		// child of
+		t.Errorf("%s: bad relay parent %s", t.Name(), fs.Parent)
+	}
+	if bcs.Parent != fs.ID {
+		t.Errorf("%s: echo client span parent %s != relay span %s",
+			t.Name(), bcs.Parent, fs.ID)
+	}
+	if fs.Status != 200 || bcs.Status != 200 || fs.BytesIn != 5 || fs.BytesOut != 5 ||
+		bcs.BytesIn != 5 || bcs.BytesOut != 5 {
+		t.Errorf("%s: bad span data: %+v %+v", t.Name(), fs, bcs)
+	}
+	if fs.Peer == "" || bcs.Peer != sn2 && !strings.HasSuffix(bcs.Peer, ":60607") {
+		t.Errorf("%s: bad peers: %q %q", t.Name(), fs.Peer, bcs.Peer)
+	}
+}
+
+// compression is negotiated during the handshake, and applies in
+// both directions
+func TestServerCompression(t *testing.T) {
+	s, err := New(&Config{Addr: sn, Xferlim: 4096, CompressMin: 16,
+		Compress: []string{"flate", "gzip"}})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	_ = s.Register("echo", echoHandler)
+
+	// the client's preference wins
+	cc, err := pc.New(&pc.Config{Addr: sn, CompressMin: 16,
+		Compress: []string{"zstd", "gzip", "flate"}})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+	if cc.Compression() != "gzip" {
+		t.Errorf("%s: expected gzip, got %q", t.Name(), cc.Compression())
+	}
+	pl := []byte(strings.Repeat("all work and no play ", 150))
+	if err = cc.Dispatch("echo", pl); err != nil || string(cc.Resp.Payload) != string(pl) {
+		t.Errorf("%s: compressed echo failed: %v", t.Name(), err)
+	}
+
+	// a client which asks for nothing gets nothing
+	cc2, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc2.Quit()
+	if cc2.Compression() != "" {
+		t.Errorf("%s: expected no compression, got %q", t.Name(), cc2.Compression())
+	}
+	if err = cc2.Dispatch("echo", pl); err != nil || string(cc2.Resp.Payload) != string(pl) {
+		t.Errorf("%s: uncompressed echo failed: %v", t.Name(), err)
+	}
+
+	// Xferlim applies once a payload is decompressed
+	big := make([]byte, 8192)
+	_ = cc.Dispatch("echo", big)
+	if cc.Resp.Status != 402 {
+		t.Errorf("%s: expected 402, got %d", t.Name(), cc.Resp.Status)
+	}
+}
+
+type addArgs struct {
+	X, Y int
+}
+
+// typed handlers decode and encode their payloads with the Server's
+// Codec
+func TestServerTyped(t *testing.T) {
+	for _, codec := range []p.Codec{p.JSONCodec, p.GobCodec} {
+		s, err := New(&Config{Addr: sn, Codec: codec})
+		if err != nil {
+			t.Fatalf("%s: failed: %s", t.Name(), err)
+		}
+		err = RegisterTyped(s, "add", func(_ context.Context, a addArgs) (int, error) {
+			if a.X < 0 {
+				return 0, fmt.Errorf("negative")
+			}
+			return a.X + a.Y, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: register failed: %s", t.Name(), err)
+		}
+		cc, err := pc.New(&pc.Config{Addr: sn, Codec: codec})
+		if err != nil {
+			t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+		}
+
+		sum, err := pc.DispatchTyped[addArgs, int](cc, "add", addArgs{2, 3})
+		if err != nil || sum != 5 {
+			t.Errorf("%s: %s: bad sum %d: %v", t.Name(), codec.Name(), sum, err)
+		}
+		var se *pc.StatusError
+		// undecodable requests are 422s, and leave the conn open
+		_, err = pc.DispatchTyped[string, int](cc, "add", "two and three")
+		if !errors.As(err, &se) || se.Status != 422 || len(se.Payload) == 0 {
+			t.Errorf("%s: %s: expected 422, got %v", t.Name(), codec.Name(), err)
+		}
+		if cc.Closed() {
+			t.Errorf("%s: %s: 422 closed the conn", t.Name(), codec.Name())
+		}
+		// a response which can't be decoded is an error, but
+		// not a StatusError
+		_, err = pc.DispatchTyped[addArgs, []string](cc, "add", addArgs{1, 1})
+		if err == nil || errors.As(err, &se) {
+			t.Errorf("%s: %s: expected decode error, got %v", t.Name(), codec.Name(), err)
+		}
+		// handler errors are 520s, which leave the conn open
+		_, err = pc.DispatchTyped[addArgs, int](cc, "add", addArgs{-1, 3})
+		if !errors.As(err, &se) || se.Status != 520 || string(se.Payload) != "negative" {
+			t.Errorf("%s: %s: expected 520, got %v", t.Name(), codec.Name(), err)
+		}
+		if cc.Closed() {
+			t.Errorf("%s: %s: client should still be open", t.Name(), codec.Name())
+		}
+		cc.Quit()
+		s.Quit()
+	}
+}
+
+// arith is a service for TestServerService
+type arith struct{}
+
+type quotient struct {
+	Quo, Rem int
+}
+
+func (arith) Divide(_ context.Context, a *addArgs) (*quotient, error) {
+	if a.Y == 0 {
+		return nil, fmt.Errorf("divide by zero")
+	}
+	return &quotient{a.X / a.Y, a.X % a.Y}, nil
+}
+
+func (arith) Add(_ context.Context, a addArgs) (int, error) {
+	return a.X + a.Y, nil
+}
+
+// not a service method
+func (arith) Helper(x int) int { return x }
+
+// service methods are registered by reflection, and callable through
+// a client.Service
+func TestServerService(t *testing.T) {
+	s, err := New(&Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	if err = s.RegisterService("Arith", arith{}); err != nil {
+		t.Fatalf("%s: register failed: %s", t.Name(), err)
+	}
+	for _, name := range []string{"Arith.Divide", "Arith.Add"} {
+		if _, ok := s.d[name]; !ok {
+			t.Errorf("%s: %s not registered", t.Name(), name)
+		}
+	}
+	if _, ok := s.d["Arith.Helper"]; ok {
+		t.Errorf("%s: Arith.Helper should not be registered", t.Name())
+	}
+	if err = s.RegisterService("Nope", struct{}{}); err == nil {
+		t.Errorf("%s: registering a service with no methods should fail", t.Name())
+	}
+
+	cc, err := pc.New(&pc.Config{Addr: sn})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+	svc := pc.NewService(cc, "Arith")
+	var q quotient
+	err = svc.Call(context.Background(), "Divide", &addArgs{17, 5}, &q)
+	if err != nil || q.Quo != 3 || q.Rem != 2 {
+		t.Errorf("%s: bad quotient %+v: %v", t.Name(), q, err)
+	}
+	var sum int
+	err = svc.Call(context.Background(), "Add", addArgs{17, 5}, &sum)
+	if err != nil || sum != 22 {
+		t.Errorf("%s: bad sum %d: %v", t.Name(), sum, err)
+	}
+	var se *pc.StatusError
+	err = svc.Call(context.Background(), "Divide", "seventeen", &q)
+	if !errors.As(err, &se) || se.Status != 422 {
+		t.Errorf("%s: expected 422, got %v", t.Name(), err)
+	}
+	err = svc.Call(context.Background(), "Subtract", addArgs{1, 1}, &sum)
+	if !errors.As(err, &se) || se.Status != 400 {
+		t.Errorf("%s: expected 400, got %v", t.Name(), err)
+	}
+	err = svc.Call(context.Background(), "Divide", &addArgs{1, 0}, &q)
+	if !errors.As(err, &se) || se.Status != 520 || len(se.Payload) == 0 {
+		t.Errorf("%s: expected 520, got %v", t.Name(), err)
+	}
+	// a method's error does not cost the connection
+	err = svc.Call(context.Background(), "Add", addArgs{1, 2}, &sum)
+	if err != nil || sum != 3 {
+		t.Errorf("%s: call after method error failed: %d %v", t.Name(), sum, err)
+	}
+}
+
+// request bodies are streamed to BodyHandlers in chunks, so they can
+// be far bigger than Xferlim
+func TestServerBody(t *testing.T) {
+	key := []byte("sekrit")
+	s, err := New(&Config{Addr: sn, Xferlim: 32 * 1024, HMACKey: key})
+	if err != nil {
+		t.Fatalf("%s: failed: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	// echo the body back as it arrives
+	_ = s.RegisterBody("copy", func(_ context.Context, _ *Request, body io.Reader, w io.Writer) (uint16, error) {
+		buf := make([]byte, 8192)
+		if _, err := io.CopyBuffer(w, body, buf); err != nil {
+			return 500, err
+		}
+		return 200, nil
+	})
+	// read only the start of the body
+	_ = s.RegisterBody("head", func(_ context.Context, _ *Request, body io.Reader, w io.Writer) (uint16, error) {
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(body, b); err != nil {
+			return 500, err
+		}
+		_, err := w.Write(b)
+		return 200, err
+	})
+	_ = s.Register("echo", echoHandler)
+
+	cc, err := pc.New(&pc.Config{Addr: sn, HMACKey: key, Xferlim: 32 * 1024,
+		ChunkSize: 16 * 1024})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer cc.Quit()
+
+	in := make([]byte, 1024*1024+17)
+	for i := range in {
+		in[i] = byte(i * 7)
+	}
+	var out bytes.Buffer
+	resp, err := cc.DispatchBody(context.Background(), "copy", bytes.NewReader(in), &out)
+	if err != nil || resp.Status != 200 {
+		t.Fatalf("%s: copy failed: %v %v", t.Name(), resp, err)
+	}
+	if !bytes.Equal(in, out.Bytes()) {
+		t.Errorf("%s: body mangled: sent %d bytes, got %d", t.Name(), len(in), out.Len())
+	}
+
+	// a body which fits in one chunk, and a plain request, both
+	// work too
+	out.Reset()
+	resp, err = cc.DispatchBody(context.Background(), "copy", strings.NewReader("small"), &out)
+	if err != nil || resp.Status != 200 || out.String() != "small" {
+		t.Errorf("%s: small copy failed: %v %v %q", t.Name(), resp, err, out.String())
+	}
+	if err = cc.Dispatch("copy", []byte("plain")); err != nil || cc.Resp.Status != 200 ||
+		string(cc.Resp.Payload) != "plain" {
+		t.Errorf("%s: plain copy failed: %v %d %q", t.Name(), err, cc.Resp.Status,
+			cc.Resp.Payload)
+	}
+
+	// a handler which stops reading early leaves the rest of the
+	// body to be discarded
+	out.Reset()
+	resp, err = cc.DispatchBody(context.Background(), "head", bytes.NewReader(in), &out)
+	if err != nil || resp.Status != 200 || !bytes.Equal(out.Bytes(), in[:4]) {
+		t.Errorf("%s: head failed: %v %v %v", t.Name(), resp, err, out.Bytes())
+	}
+
+	// handlers which don't take bodies refuse them
+	resp, err = cc.DispatchBody(context.Background(), "echo", bytes.NewReader(in), &out)
+	if err != nil || resp.Status != 422 {
+		t.Errorf("%s: expected 422, got %v %v", t.Name(), resp, err)
+	}
+
+	// and after all that, the conn is still in good order
+	if err = cc.Dispatch("echo", []byte("still here")); err != nil ||
+		string(cc.Resp.Payload) != "still here" {
+		t.Errorf("%s: conn is broken: %v %q", t.Name(), err, cc.Resp.Payload)
+	}
+	m := s.Metrics()
+	for i := 0; i < 100 && m.Handlers["copy"].Requests < 3; i++ {
+		time.Sleep(time.Millisecond)
+		m = s.Metrics()
+	}
+	if m.Handlers["copy"].BytesIn != uint64(len(in)+len("small")+len("plain")) {
+		t.Errorf("%s: bad BytesIn: %d", t.Name(), m.Handlers["copy"].BytesIn)
+	}
+}
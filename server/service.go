@@ -0,0 +1,99 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Reflection-based service registration
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+var (
+	ctxType = reflect.TypeFor[context.Context]()
+	errType = reflect.TypeFor[error]()
+)
+
+// RegisterService registers the methods of svc as handlers, in the
+// manner of net/rpc. Each exported method of the form
+//
+//	func (t *T) Method(ctx context.Context, args *Args) (*Reply, error)
+//
+// is registered as "prefix.Method". Args and Reply may be any types
+// the Server's Codec can handle, and need not be pointers. As with
+// RegisterTyped, the request payload is decoded into an Args (status
+// 422 if that fails), and the Reply is encoded as the response
+// payload. Methods which do not have this form are skipped; it is an
+// error if none do. Any Middleware given applies to every method.
+//
+// As in net/rpc, an error returned by a method is an ordinary
+// outcome: it is sent with status 520, with its text as the payload,
+// and the connection stays open. A method which returns a
+// *StatusError sends that status instead.
+//
+// Clients call service methods with client.Service, or with
+// DispatchTyped using the full request name.
+func (s *Server) RegisterService(prefix string, svc any, mw ...Middleware) error {
+	v := reflect.ValueOf(svc)
+	t := v.Type()
+	n := 0
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !m.IsExported() || !serviceMethod(m.Type) {
+			continue
+		}
+		err := s.RegisterCtx(prefix+"."+m.Name, s.methodHandler(v.Method(i)), mw...)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("type %s has no methods suitable for a service", t)
+	}
+	return nil
+}
+
+// serviceMethod reports whether a method type (which includes its
+// receiver) has the form RegisterService wants
+func serviceMethod(mt reflect.Type) bool {
+	return mt.NumIn() == 3 && mt.In(1) == ctxType &&
+		mt.NumOut() == 2 && mt.Out(1) == errType
+}
+
+// methodHandler wraps a bound service method as a HandlerCtx
+func (s *Server) methodHandler(fn reflect.Value) HandlerCtx {
+	at := fn.Type().In(1)
+	return func(ctx context.Context, r *Request) (uint16, []byte, error) {
+		// decode into a new Args, and pass it as the method
+		// wants it: as a pointer or not
+		var args reflect.Value
+		if at.Kind() == reflect.Pointer {
+			args = reflect.New(at.Elem())
+		} else {
+			args = reflect.New(at)
+		}
+		if len(r.Payload) > 0 {
+			if err := s.cdc.Unmarshal(r.Payload, args.Interface()); err != nil {
+				return 422, []byte(fmt.Sprintf("couldn't decode request (%s): %s",
+					s.cdc.Name(), err)), nil
+			}
+		}
+		if at.Kind() != reflect.Pointer {
+			args = args.Elem()
+		}
+		out := fn.Call([]reflect.Value{reflect.ValueOf(ctx), args})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return errStatus(err)
+		}
+		payload, err := s.cdc.Marshal(out[0].Interface())
+		if err != nil {
+			return 500, nil, fmt.Errorf("couldn't encode response (%s): %w",
+				s.cdc.Name(), err)
+		}
+		return 200, payload, nil
+	}
+}
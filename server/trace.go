@@ -0,0 +1,49 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Request tracing
+
+import (
+	"time"
+
+	p "github.com/firepear/petrel"
+)
+
+// startSpan begins a span for a request, if it is being traced: that
+// is, if it arrived with a trace context, or if the Server has a
+// Tracer. It sets r.Trace, and returns nil if the request is not
+// being traced.
+func (s *Server) startSpan(req *p.Resp, r *Request) *p.Span {
+	_, nop := s.tr.(p.NopTracer)
+	if req.Trace.IsZero() && nop {
+		return nil
+	}
+	if req.Trace.IsZero() {
+		r.Trace = p.NewTrace()
+	} else {
+		r.Trace = req.Trace.Child()
+	}
+	span := &p.Span{Trace: r.Trace.ID, ID: r.Trace.Span,
+		Parent: req.Trace.Span, Kind: "server", Name: r.Name,
+		Start: time.Now(), BytesIn: len(r.Payload)}
+	if r.RemoteAddr != nil {
+		span.Peer = r.RemoteAddr.String()
+	}
+	s.tr.SpanStart(span)
+	return span
+}
+
+// endSpan ends a request's span, once its response has been sent
+func (s *Server) endSpan(span *p.Span, status uint16, response []byte, sw *streamWriter, err error) {
+	span.End = time.Now()
+	span.Status = status
+	span.BytesOut = len(response)
+	if sw != nil {
+		span.BytesOut += int(sw.n.Load())
+	}
+	span.Err = err
+	s.tr.SpanEnd(span)
+}
@@ -0,0 +1,76 @@
+package server
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Typed handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// StatusError is an error which a typed handler (see RegisterTyped
+// and RegisterService) can return to send a particular status,
+// rather than 520. Msg is sent as the response payload. Status must
+// be one of the petrel.Stats, or an application status over 1024.
+type StatusError struct {
+	Status uint16
+	Msg    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Msg)
+}
+
+// errStatus returns the status and payload for an error returned by a
+// typed handler. An error which is not a StatusError is an ordinary
+// outcome of the request, rather than a failure of the connection,
+// so it is sent as a 520 with its text as the payload.
+func errStatus(err error) (uint16, []byte, error) {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Status, []byte(se.Msg), nil
+	}
+	return 520, []byte(err.Error()), nil
+}
+
+// RegisterTyped adds a typed handler to a Server. The request payload
+// is decoded into a Req with the Server's Codec, and whatever f
+// returns is encoded as the response payload:
+//
+//	server.RegisterTyped(s, "add", func(ctx context.Context, a Args) (int, error) {
+//		return a.X + a.Y, nil
+//	})
+//
+// An empty payload decodes as the zero Req. A payload which cannot be
+// decoded is refused with status 422 (bad request), whose payload
+// says why, and f is not called. If f returns a *StatusError, its
+// Status and Msg are the response; any other error is sent with
+// status 520 and its text as the payload, and the connection stays
+// open, as for RegisterService. Clients make typed requests with
+// client.DispatchTyped. RegisterTyped is a function, rather than a
+// method, because methods cannot have type parameters.
+func RegisterTyped[Req, Resp any](s *Server, name string, f func(context.Context, Req) (Resp, error), mw ...Middleware) error {
+	return s.RegisterCtx(name, func(ctx context.Context, r *Request) (uint16, []byte, error) {
+		var in Req
+		if len(r.Payload) > 0 {
+			if err := s.cdc.Unmarshal(r.Payload, &in); err != nil {
+				return 422, []byte(fmt.Sprintf("couldn't decode request (%s): %s",
+					s.cdc.Name(), err)), nil
+			}
+		}
+		out, err := f(ctx, in)
+		if err != nil {
+			return errStatus(err)
+		}
+		payload, err := s.cdc.Marshal(out)
+		if err != nil {
+			return 500, nil, fmt.Errorf("couldn't encode response (%s): %w",
+				s.cdc.Name(), err)
+		}
+		return 200, payload, nil
+	}, mw...)
+}
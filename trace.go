@@ -0,0 +1,155 @@
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+package petrel
+
+// Trace propagation and reporting
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// TraceID identifies a trace: all the work done on behalf of one
+// original request, across any number of clients and servers.
+type TraceID [16]byte
+
+// SpanID identifies a span: one request, as seen by one side of a
+// connection.
+type SpanID [8]byte
+
+// String returns the TraceID in hex.
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// String returns the SpanID in hex.
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// Trace is the trace context carried by a transmission. When it is
+// set on a Resp, the transmission has FlagTrace set, and the trace
+// context follows the request name on the wire.
+type Trace struct {
+	ID   TraceID
+	Span SpanID
+}
+
+// NewTrace returns a Trace with a new, random TraceID and SpanID.
+func NewTrace() Trace {
+	var t Trace
+	binary.LittleEndian.PutUint64(t.ID[:8], rand.Uint64())
+	binary.LittleEndian.PutUint64(t.ID[8:], rand.Uint64())
+	return t.Child()
+}
+
+// Child returns a Trace in the same trace as t, with a new SpanID.
+func (t Trace) Child() Trace {
+	binary.LittleEndian.PutUint64(t.Span[:], rand.Uint64())
+	return t
+}
+
+// IsZero reports whether t is unset.
+func (t Trace) IsZero() bool {
+	return t == Trace{}
+}
+
+// traceKey is the context key for a Trace
+type traceKey struct{}
+
+// ContextWithTrace returns a copy of ctx which carries t. A client
+// request made with the returned context will be part of t's trace.
+func ContextWithTrace(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFromContext returns the Trace carried by ctx, if there is one.
+func TraceFromContext(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(traceKey{}).(Trace)
+	return t, ok
+}
+
+// Span is one request, as seen by a client or a server. It is
+// reported to a Tracer when it starts and again when it ends.
+type Span struct {
+	// Trace is the trace the span belongs to
+	Trace TraceID
+	// ID is the span's id
+	ID SpanID
+	// Parent is the id of the span which caused this one. It is
+	// zero for the first span in a trace.
+	Parent SpanID
+	// Kind is "client" or "server"
+	Kind string
+	// Name is the request name
+	Name string
+	// Peer is the address of the other side of the connection
+	Peer string
+	// Start and End are when the span started and ended. End is
+	// zero until the span has ended.
+	Start time.Time
+	End   time.Time
+	// Status is the response status, set when the span ends
+	Status uint16
+	// BytesIn and BytesOut are the payload bytes received and
+	// sent, set when the span ends
+	BytesIn  int
+	BytesOut int
+	// Err is any error the request ended with
+	Err error
+}
+
+// Tracer receives spans as they start and end. Its methods are
+// called synchronously, from the goroutines handling requests, so
+// they should return quickly. They must not modify the Span.
+type Tracer interface {
+	SpanStart(s *Span)
+	SpanEnd(s *Span)
+}
+
+// NopTracer is a Tracer which does nothing. It is the default.
+type NopTracer struct{}
+
+// SpanStart implements Tracer.
+func (NopTracer) SpanStart(*Span) {}
+
+// SpanEnd implements Tracer.
+func (NopTracer) SpanEnd(*Span) {}
+
+// SlogTracer is a Tracer which logs each span as it ends. If Logger
+// is nil, slog.Default() is used. Spans are logged at Debug, unless
+// they end with an error or an Error level status, in which case
+// they are logged at Warn.
+type SlogTracer struct {
+	Logger *slog.Logger
+}
+
+// SpanStart implements Tracer. Nothing is logged until the span ends.
+func (SlogTracer) SpanStart(*Span) {}
+
+// SpanEnd implements Tracer.
+func (t SlogTracer) SpanEnd(s *Span) {
+	l := t.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	lvl := slog.LevelDebug
+	if s.Err != nil || (s.Status <= 1024 && Stats[s.Status] != nil &&
+		Stats[s.Status].Lvl == "Error") {
+		lvl = slog.LevelWarn
+	}
+	l.Log(context.Background(), lvl, "span",
+		"trace", s.Trace.String(),
+		"span", s.ID.String(),
+		"parent", s.Parent.String(),
+		"kind", s.Kind,
+		"req", s.Name,
+		"peer", s.Peer,
+		"status", s.Status,
+		"in", s.BytesIn,
+		"out", s.BytesOut,
+		"dur", s.End.Sub(s.Start),
+		"err", s.Err)
+}
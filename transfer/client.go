@@ -0,0 +1,280 @@
+package transfer
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Client side helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	pc "github.com/firepear/petrel/client"
+)
+
+// ClientConfig holds the configuration of a transfer Client.
+type ClientConfig struct {
+	// Prefix is the prefix the server's transfer handlers were
+	// registered under. Default ("") is DefaultPrefix.
+	Prefix string
+
+	// ChunkSize is the size, in bytes, of the chunks files are
+	// sent in. It must not be more than the server's MaxChunk.
+	// Default (0) is DefaultChunkSize.
+	ChunkSize int64
+
+	// Parallel is the number of chunks which are sent at once.
+	// Default (0) is 4.
+	Parallel int
+
+	// Retries is the number of times a transfer is resumed after
+	// a failure, before giving up. Failures which the server
+	// blames on the request, with a status in the 400s, are not
+	// retried. Resuming after a dropped connection needs a petrel
+	// Client with a Reconnect policy. Default (0) is 3; a
+	// negative value is no retries.
+	Retries int
+
+	// RetryDelay is the wait before the first retry. Each retry
+	// after that waits twice as long as the last, up to ten
+	// seconds, and half of each wait is randomized, so that
+	// transfers which failed together do not all retry together.
+	// A server's rate limit hint, if it gives one, is waited out
+	// in full. Default (0) is 100ms.
+	RetryDelay time.Duration
+}
+
+// Client uploads files to, and downloads files from, a server with
+// the transfer handlers. It is safe for concurrent use.
+type Client struct {
+	c        *pc.Client
+	prefix   string
+	chunk    int64
+	parallel int
+	retries  int
+	delay    time.Duration
+}
+
+// NewClient returns a Client which makes its requests with c. conf
+// may be nil, for the defaults.
+func NewClient(c *pc.Client, conf *ClientConfig) *Client {
+	if conf == nil {
+		conf = &ClientConfig{}
+	}
+	t := &Client{c: c, prefix: conf.Prefix, chunk: conf.ChunkSize,
+		parallel: conf.Parallel, retries: conf.Retries, delay: conf.RetryDelay}
+	if t.prefix == "" {
+		t.prefix = DefaultPrefix
+	}
+	if t.chunk <= 0 {
+		t.chunk = DefaultChunkSize
+	}
+	if t.parallel <= 0 {
+		t.parallel = 4
+	}
+	if t.retries == 0 {
+		t.retries = 3
+	}
+	if t.delay <= 0 {
+		t.delay = 100 * time.Millisecond
+	}
+	return t
+}
+
+// Stat returns the Manifest of the file at remote on the server.
+func (t *Client) Stat(ctx context.Context, remote string) (*Manifest, error) {
+	return pc.DispatchTypedCtx[statReq, *Manifest](ctx, t.c, t.prefix+".stat",
+		statReq{Path: remote, ChunkSize: t.chunk})
+}
+
+// Upload copies the local file to remote, a path relative to the
+// server's root. Directories leading to remote are created as
+// needed, and an existing file is replaced once the new one is
+// complete. If an earlier Upload of the same file to the same place
+// was interrupted, only the chunks the server is missing are sent.
+func (t *Client) Upload(ctx context.Context, local, remote string) error {
+	m, err := fileManifest(local, remote, t.chunk)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.retry(ctx, func() error {
+		have, err := pc.DispatchTypedCtx[*Manifest, []bool](ctx, t.c,
+			t.prefix+".begin", m)
+		if err != nil {
+			return err
+		}
+		if len(have) != len(m.Chunks) {
+			return fmt.Errorf("transfer: server has %d chunks of %d",
+				len(have), len(m.Chunks))
+		}
+		err = t.each(ctx, have, func(ctx context.Context, i int) error {
+			off, n := m.chunk(i)
+			data := make([]byte, n)
+			if _, err := f.ReadAt(data, off); err != nil {
+				return err
+			}
+			if !m.sumOK(i, data) {
+				return fmt.Errorf("transfer: %s changed during upload", local)
+			}
+			return t.request(ctx, ".put", putPayload(remote, i, data), nil)
+		})
+		if err != nil {
+			return err
+		}
+		_, err = pc.DispatchTypedCtx[commitReq, *Manifest](ctx, t.c,
+			t.prefix+".commit", commitReq{Path: remote})
+		return err
+	})
+}
+
+// Download copies remote, a path relative to the server's root, to
+// the local file, which is replaced once the download is complete.
+// While the download is underway, it is kept in a hidden file next to
+// local. If an earlier Download of the same file to the same place
+// was interrupted, and the file has not changed since, only the
+// chunks which are missing are fetched.
+func (t *Client) Download(ctx context.Context, remote, local string) error {
+	return t.retry(ctx, func() error {
+		m, err := t.Stat(ctx, remote)
+		if err != nil {
+			return err
+		}
+		if m.ChunkSize != t.chunk {
+			return fmt.Errorf("transfer: bad manifest for %s: chunk size %d",
+				remote, m.ChunkSize)
+		}
+		if err = m.check(t.chunk, 0); err != nil {
+			return fmt.Errorf("transfer: bad manifest for %s: %w", remote, err)
+		}
+		have, err := prepare(local, m)
+		if err != nil {
+			return err
+		}
+		part, _ := partNames(local)
+		f, err := os.OpenFile(part, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = t.each(ctx, have, func(ctx context.Context, i int) error {
+			off, n := m.chunk(i)
+			var data []byte
+			if err := t.request(ctx, ".get", getPayload(remote, off, n), &data); err != nil {
+				return err
+			}
+			if int64(len(data)) != n || !m.sumOK(i, data) {
+				// either it changed on the server, or it
+				// was damaged; both warrant another try
+				return fmt.Errorf("transfer: %s: chunk %d", errChecksum, i)
+			}
+			_, err := f.WriteAt(data, off)
+			return err
+		})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return finish(local, m)
+	})
+}
+
+// request sends a put or get request. If out is not nil, the response
+// payload is stored there.
+func (t *Client) request(ctx context.Context, name string, payload []byte, out *[]byte) error {
+	resp, err := t.c.RoundTrip(ctx, t.prefix+name, payload)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 200 {
+		return &pc.StatusError{Req: t.prefix + name, Status: resp.Status,
+			Payload: resp.Payload}
+	}
+	if out != nil {
+		*out = resp.Payload
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, fails with a status in the 400s,
+// or has been retried t.retries times, backing off between tries. As
+// each call starts over from whatever was transferred by the last, a
+// retry is a resume. If ctx is done while waiting, the last error is
+// returned.
+func (t *Client) retry(ctx context.Context, f func() error) error {
+	delay := t.delay
+	for try := 0; ; try++ {
+		err := f()
+		var se *pc.StatusError
+		if err == nil || ctx.Err() != nil || try >= t.retries ||
+			(errors.As(err, &se) && se.Status >= 400 && se.Status < 500) {
+			return err
+		}
+		wait := delay/2 + rand.N(delay/2+1)
+		var rl *pc.RateLimitError
+		if errors.As(err, &rl) {
+			wait = max(wait, rl.RetryAfter)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, 10*time.Second)
+	}
+}
+
+// each calls f, from up to t.parallel goroutines at once, for each
+// chunk which is not in have. It stops at the first error.
+func (t *Client) each(ctx context.Context, have []bool, f func(context.Context, int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		ferr error
+		ch   = make(chan int)
+	)
+	for range t.parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				if err := f(ctx, i); err != nil {
+					once.Do(func() {
+						ferr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for i, ok := range have {
+		if ok {
+			continue
+		}
+		select {
+		case ch <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if ferr != nil {
+		return ferr
+	}
+	return ctx.Err()
+}
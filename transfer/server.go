@@ -0,0 +1,479 @@
+package transfer
+
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Server side handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	ps "github.com/firepear/petrel/server"
+)
+
+// Config holds the configuration of the transfer handlers.
+type Config struct {
+	// Root is the directory files are uploaded to and downloaded
+	// from. Paths in requests are relative to it, and may not
+	// lead outside of it, by way of ".." or of symlinks. It is
+	// required.
+	Root string
+
+	// Prefix is prepended, with a dot, to the names of the
+	// handlers, so that several roots can be served by one
+	// Server. Default ("") is DefaultPrefix.
+	Prefix string
+
+	// MaxChunk is the largest chunk size, in bytes, which will
+	// be accepted or sent. The Server's Xferlim must leave room
+	// for a chunk of this size, plus its path and 10 bytes of
+	// header. Default (0) is DefaultMaxChunk.
+	MaxChunk int64
+
+	// MaxSize is the largest file, in bytes, which may be
+	// uploaded. Room for the whole file is set aside when its
+	// upload begins. Default (0) is DefaultMaxSize.
+	MaxSize int64
+
+	// MaxUploads is the number of uploads which may be in
+	// progress at once. Requests which would start another are
+	// refused with status 429. Default (0) is DefaultMaxUploads.
+	MaxUploads int
+
+	// UploadTimeout is the number of milliseconds an upload may
+	// go without a request before it is abandoned. Abandoned
+	// uploads, and their partial files, are cleared away as new
+	// uploads begin. Default (0) is DefaultUploadTimeout.
+	UploadTimeout int64
+}
+
+// files is the state of the transfer handlers
+type files struct {
+	root   string
+	max    int64
+	maxsz  int64
+	maxups int
+	idle   time.Duration
+	mu     sync.Mutex
+	ups    map[string]*upload
+}
+
+// upload is an upload in progress
+type upload struct {
+	mu sync.Mutex
+	m  *Manifest
+	// when the upload was last used. it is guarded by files.mu
+	t time.Time
+	// the upload has been abandoned
+	gone bool
+	// the number of puts writing to the partial file
+	busy int
+}
+
+// statReq is the request of the stat handler
+type statReq struct {
+	Path      string
+	ChunkSize int64
+}
+
+// commitReq is the request of the commit handler
+type commitReq struct {
+	Path string
+}
+
+// Register adds the transfer handlers to a Server. They are named
+// after c.Prefix:
+//
+//	PREFIX.stat    returns the Manifest of a file
+//	PREFIX.get     returns part of a file
+//	PREFIX.begin   starts or resumes an upload, and returns which
+//	               chunks the server already has
+//	PREFIX.put     receives one chunk of an upload
+//	PREFIX.commit  checks an upload, and puts the file in place
+//
+// A path which leads outside of c.Root gets status 403, and a file
+// which does not exist gets 404. A chunk which does not match its
+// checksum gets 422, as does an upload of a file larger than
+// c.MaxSize. An upload which would be one more than c.MaxUploads
+// gets 429. 'mw' is optional Middleware, applied to all of the
+// handlers.
+func Register(s *ps.Server, c *Config, mw ...ps.Middleware) error {
+	if c.Root == "" {
+		return fmt.Errorf("transfer: no root directory")
+	}
+	root, err := filepath.Abs(c.Root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return fmt.Errorf("transfer: bad root directory: %w", err)
+	}
+	t := &files{root: root, max: c.MaxChunk, maxsz: c.MaxSize, maxups: c.MaxUploads,
+		idle: time.Duration(c.UploadTimeout) * time.Millisecond,
+		ups:  map[string]*upload{}}
+	if t.max <= 0 {
+		t.max = DefaultMaxChunk
+	}
+	if t.maxsz <= 0 {
+		t.maxsz = DefaultMaxSize
+	}
+	if t.maxups <= 0 {
+		t.maxups = DefaultMaxUploads
+	}
+	if t.idle <= 0 {
+		t.idle = DefaultUploadTimeout * time.Millisecond
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	if err = ps.RegisterTyped(s, prefix+".stat", t.stat, mw...); err != nil {
+		return err
+	}
+	if err = s.RegisterCtx(prefix+".get", t.get, mw...); err != nil {
+		return err
+	}
+	if err = ps.RegisterTyped(s, prefix+".begin", t.begin, mw...); err != nil {
+		return err
+	}
+	if err = s.RegisterCtx(prefix+".put", t.put, mw...); err != nil {
+		return err
+	}
+	return ps.RegisterTyped(s, prefix+".commit", t.commit, mw...)
+}
+
+// resolve turns a request path into a filesystem path, making sure
+// that it, and the partial file and manifest of an upload to it, are
+// strictly inside the root
+func (t *files) resolve(path string) (string, error) {
+	local := filepath.FromSlash(path)
+	if !filepath.IsLocal(local) || filepath.Clean(local) == "." {
+		return "", &ps.StatusError{Status: 403, Msg: "path outside root: " + path}
+	}
+	name := filepath.Join(t.root, local)
+	part, mfile := partNames(name)
+	for _, n := range []string{name, part, mfile} {
+		if err := t.inside(n); err != nil {
+			if errors.Is(err, errOutside) {
+				return "", &ps.StatusError{Status: 403, Msg: "path outside root: " + path}
+			}
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// errOutside is returned by inside for a path outside the root
+var errOutside = errors.New("path outside root")
+
+// inside checks that name is strictly inside the root. A symlink could
+// lead out of the root, so the deepest part of name which exists is
+// checked once it is resolved. That may be the root itself, if it is
+// a parent of name, but not if it is name. A dangling symlink leads
+// nowhere that can be checked, so it is refused.
+func (t *files) inside(name string) error {
+	for dir := name; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		real, err := filepath.EvalSymlinks(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return errOutside
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.root, real)
+		if err != nil || !filepath.IsLocal(rel) || (dir == name && rel == ".") {
+			return errOutside
+		}
+		return nil
+	}
+}
+
+// open opens a file for reading
+func (t *files) open(path string) (*os.File, error) {
+	name, err := t.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &ps.StatusError{Status: 404, Msg: "no such file: " + path}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, &ps.StatusError{Status: 422, Msg: "not a regular file: " + path}
+	}
+	return f, nil
+}
+
+// upload returns the state of the upload to name, starting one if
+// there is none. Starting an upload clears away any which have been
+// abandoned, and is refused if too many are in progress.
+func (t *files) upload(name string) (*upload, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	u, ok := t.ups[name]
+	if !ok {
+		t.sweep(now)
+		if len(t.ups) >= t.maxups {
+			return nil, &ps.StatusError{Status: 429, Msg: t.retryAfter(now)}
+		}
+		u = &upload{}
+		t.ups[name] = u
+	}
+	u.t = now
+	return u, nil
+}
+
+// sweep removes uploads which have been idle for longer than t.idle,
+// along with their partial files. An upload which is in use is not
+// idle, however long ago it began. t.mu must be held.
+func (t *files) sweep(now time.Time) {
+	for name, u := range t.ups {
+		if now.Sub(u.t) <= t.idle || !u.mu.TryLock() {
+			continue
+		}
+		if u.busy > 0 {
+			u.mu.Unlock()
+			continue
+		}
+		u.gone = true
+		part, mfile := partNames(name)
+		_ = os.Remove(part)
+		_ = os.Remove(mfile)
+		delete(t.ups, name)
+		u.mu.Unlock()
+	}
+}
+
+// retryAfter returns the retry hint for a refused upload: the time
+// until the least recently used upload can be abandoned, in
+// milliseconds. t.mu must be held.
+func (t *files) retryAfter(now time.Time) string {
+	oldest := now
+	for _, u := range t.ups {
+		if u.t.Before(oldest) {
+			oldest = u.t
+		}
+	}
+	wait := t.idle - now.Sub(oldest)
+	return strconv.FormatInt(max(wait.Milliseconds(), 1), 10)
+}
+
+// hold marks u busy, so that it is not swept away while its partial
+// file is being written. It reports false if u has been abandoned.
+// Each successful hold must be matched by a call to release.
+func (u *upload) hold() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gone {
+		return false
+	}
+	u.busy++
+	return true
+}
+
+// release ends a hold on u
+func (u *upload) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.busy--
+}
+
+// drop forgets the upload to name, if u is still it
+func (t *files) drop(name string, u *upload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ups[name] == u {
+		delete(t.ups, name)
+	}
+}
+
+// notUploading is the error for a request about an upload which is
+// not in progress
+func notUploading(path string) error {
+	return &ps.StatusError{Status: 404, Msg: "no upload in progress: " + path}
+}
+
+// stat is the stat handler
+func (t *files) stat(_ context.Context, r statReq) (*Manifest, error) {
+	if r.ChunkSize <= 0 || r.ChunkSize > t.max {
+		return nil, &ps.StatusError{Status: 422,
+			Msg: fmt.Sprintf("chunk size %d not in 1-%d", r.ChunkSize, t.max)}
+	}
+	f, err := t.open(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return newManifest(f, r.Path, r.ChunkSize)
+}
+
+// get is the get handler
+func (t *files) get(_ context.Context, r *ps.Request) (uint16, []byte, error) {
+	path, off, n, err := parseGet(r.Payload)
+	if err != nil {
+		return 422, []byte(err.Error()), nil
+	}
+	if n > t.max {
+		return 422, []byte(fmt.Sprintf("length %d > %d", n, t.max)), nil
+	}
+	f, err := t.open(path)
+	if err != nil {
+		return errStatus(err)
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	n2, err := f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return 500, nil, err
+	}
+	return 200, b[:n2], nil
+}
+
+// begin is the begin handler
+func (t *files) begin(_ context.Context, m *Manifest) ([]bool, error) {
+	if m == nil {
+		return nil, &ps.StatusError{Status: 422, Msg: "no manifest"}
+	}
+	if err := m.check(t.max, t.maxsz); err != nil {
+		return nil, &ps.StatusError{Status: 422, Msg: err.Error()}
+	}
+	name, err := t.resolve(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+	u, err := t.upload(name)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gone {
+		return nil, notUploading(m.Path)
+	}
+	have, err := prepare(name, m)
+	if err != nil {
+		return nil, err
+	}
+	u.m = m
+	return have, nil
+}
+
+// put is the put handler
+func (t *files) put(_ context.Context, r *ps.Request) (uint16, []byte, error) {
+	path, i, data, err := parsePut(r.Payload)
+	if err != nil {
+		return 422, []byte(err.Error()), nil
+	}
+	name, err := t.resolve(path)
+	if err != nil {
+		return errStatus(err)
+	}
+	u, m, err := t.manifest(name, path)
+	if err != nil {
+		return errStatus(err)
+	}
+	if i >= len(m.Chunks) {
+		return 422, []byte(fmt.Sprintf("chunk %d of %d", i, len(m.Chunks))), nil
+	}
+	if _, n := m.chunk(i); int64(len(data)) != n || !m.sumOK(i, data) {
+		return 422, []byte(fmt.Sprintf("%s: chunk %d", errChecksum, i)), nil
+	}
+	// puts to one upload run in parallel, so u.mu is not held
+	// for the write, but u is kept from being swept away under it
+	if !u.hold() {
+		return errStatus(notUploading(path))
+	}
+	defer u.release()
+	if err = writeChunk(name, m, i, data); err != nil {
+		return 500, nil, err
+	}
+	return 200, nil, nil
+}
+
+// manifest returns the upload to name, and its Manifest. If the
+// server has restarted since the upload began, the Manifest is read
+// back from disk.
+func (t *files) manifest(name, path string) (*upload, *Manifest, error) {
+	u, err := t.upload(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gone {
+		return nil, nil, notUploading(path)
+	}
+	if u.m != nil {
+		return u, u.m, nil
+	}
+	_, mfile := partNames(name)
+	m, err := loadManifest(mfile)
+	if err == nil && (m == nil || m.check(t.max, t.maxsz) != nil) {
+		err = notUploading(path)
+	}
+	if err != nil {
+		t.drop(name, u)
+		return nil, nil, err
+	}
+	u.m = m
+	return u, m, nil
+}
+
+// commit is the commit handler
+func (t *files) commit(_ context.Context, r commitReq) (*Manifest, error) {
+	name, err := t.resolve(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	u, m, err := t.manifest(name, r.Path)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gone {
+		return nil, notUploading(r.Path)
+	}
+	if err = finish(name, m); err != nil {
+		if errors.Is(err, errChecksum) {
+			return nil, &ps.StatusError{Status: 422, Msg: err.Error()}
+		}
+		return nil, err
+	}
+	u.m = nil
+	u.gone = true
+	t.drop(name, u)
+	return m, nil
+}
+
+// errStatus turns an error from resolve, open, or manifest into a
+// handler return
+func errStatus(err error) (uint16, []byte, error) {
+	var se *ps.StatusError
+	if errors.As(err, &se) {
+		return se.Status, []byte(se.Msg), nil
+	}
+	return 500, nil, err
+}
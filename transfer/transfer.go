@@ -0,0 +1,316 @@
+// Copyright (c) 2014-2025 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Package transfer moves files between petrel clients and servers.
+//
+// Files are sent in fixed-size chunks, several at a time, and every
+// chunk is checked against a SHA-256 checksum as it arrives. The file
+// as a whole is checked again before it is put in place. A transfer
+// which is interrupted -- by a dropped connection, a timeout, or the
+// process exiting -- can be picked up again by starting it over: the
+// chunks which already arrived intact are kept, and only the rest are
+// sent.
+//
+// The server side is added to a server.Server with Register, and
+// serves files from a single root directory. The client side is a
+// Client, made with NewClient, which has Upload and Download methods.
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultPrefix is the prefix of the request names the
+	// transfer handlers are registered under, if no other is
+	// given.
+	DefaultPrefix = "transfer"
+	// DefaultChunkSize is the chunk size a Client uses if no
+	// other is given.
+	DefaultChunkSize = 256 * 1024
+	// DefaultMaxChunk is the largest chunk a server will accept
+	// or send, if no other limit is given.
+	DefaultMaxChunk = 1024 * 1024
+	// DefaultMaxSize is the largest file a server will accept
+	// for upload, if no other limit is given.
+	DefaultMaxSize = 4 * 1024 * 1024 * 1024
+	// DefaultMaxUploads is the number of uploads a server will
+	// have in progress at once, if no other limit is given.
+	DefaultMaxUploads = 64
+	// DefaultUploadTimeout is the number of milliseconds an
+	// upload may sit idle before it is abandoned, if no other
+	// timeout is given.
+	DefaultUploadTimeout = 60 * 60 * 1000
+)
+
+// Manifest describes a file as a list of chunks. Every chunk but the
+// last is ChunkSize bytes long.
+type Manifest struct {
+	// Path is the file's path, relative to the server's root
+	Path string
+	// Size is the size of the file, in bytes
+	Size int64
+	// ChunkSize is the size of the file's chunks, in bytes
+	ChunkSize int64
+	// SHA256 is the hex-encoded SHA-256 checksum of the whole
+	// file
+	SHA256 string
+	// Chunks holds the hex-encoded SHA-256 checksum of each
+	// chunk
+	Chunks []string
+}
+
+// newManifest reads r to its end, and returns its Manifest
+func newManifest(r io.Reader, path string, chunkSize int64) (*Manifest, error) {
+	m := &Manifest{Path: path, ChunkSize: chunkSize, Chunks: []string{}}
+	whole := sha256.New()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			m.Chunks = append(m.Chunks, hex.EncodeToString(sum[:]))
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return m, nil
+}
+
+// fileManifest returns the Manifest of the file at name
+func fileManifest(name, path string, chunkSize int64) (*Manifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return newManifest(f, path, chunkSize)
+}
+
+// check reports whether m is well-formed, and within the limits. A
+// maxSize of zero is no limit.
+func (m *Manifest) check(maxChunk, maxSize int64) error {
+	switch {
+	case m.ChunkSize <= 0 || m.ChunkSize > maxChunk:
+		return fmt.Errorf("chunk size %d not in 1-%d", m.ChunkSize, maxChunk)
+	case m.Size < 0:
+		return fmt.Errorf("negative size %d", m.Size)
+	case maxSize > 0 && m.Size > maxSize:
+		return fmt.Errorf("size %d > %d", m.Size, maxSize)
+	case int64(len(m.Chunks)) != (m.Size+m.ChunkSize-1)/m.ChunkSize:
+		return fmt.Errorf("%d chunk checksums for %d bytes", len(m.Chunks), m.Size)
+	}
+	return nil
+}
+
+// chunk returns the offset and length of chunk i
+func (m *Manifest) chunk(i int) (int64, int64) {
+	off := int64(i) * m.ChunkSize
+	return off, min(m.ChunkSize, m.Size-off)
+}
+
+// same reports whether m and o describe the same file, in the same
+// chunks
+func (m *Manifest) same(o *Manifest) bool {
+	return o != nil && m.Size == o.Size && m.ChunkSize == o.ChunkSize &&
+		m.SHA256 == o.SHA256
+}
+
+// verify checks the chunks of the partial file at name against m,
+// and reports which are intact. The second return is true if the
+// whole file is.
+func (m *Manifest) verify(name string) ([]bool, bool, error) {
+	got, err := fileManifest(name, m.Path, m.ChunkSize)
+	if err != nil {
+		return nil, false, err
+	}
+	have := make([]bool, len(m.Chunks))
+	for i := range have {
+		have[i] = i < len(got.Chunks) && got.Chunks[i] == m.Chunks[i]
+	}
+	return have, got.Size == m.Size && got.SHA256 == m.SHA256, nil
+}
+
+// sumOK reports whether data matches the checksum of chunk i
+func (m *Manifest) sumOK(i int, data []byte) bool {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == m.Chunks[i]
+}
+
+// partNames returns the names of the partial file and the saved
+// Manifest used while name is being transferred. They are hidden
+// files in the same directory, so that the finished file can be
+// renamed into place.
+func partNames(name string) (string, string) {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, "."+base+".petrel-part"),
+		filepath.Join(dir, "."+base+".petrel-manifest")
+}
+
+// loadManifest reads a saved Manifest. A missing one is not an error.
+func loadManifest(name string) (*Manifest, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(b, m); err != nil {
+		// a damaged manifest means starting over
+		return nil, nil
+	}
+	return m, nil
+}
+
+// prepare readies the partial file for a transfer described by m,
+// and returns which of its chunks are already intact. A partial file
+// left behind by an earlier try at the same transfer is kept;
+// otherwise a new one is made.
+func prepare(name string, m *Manifest) ([]bool, error) {
+	part, mfile := partNames(name)
+	saved, err := loadManifest(mfile)
+	if err != nil {
+		return nil, err
+	}
+	if m.same(saved) {
+		have, _, err := m.verify(part)
+		if err == nil {
+			return have, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	f, err := os.Create(part)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(m.Size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(mfile, b, 0o644); err != nil {
+		return nil, err
+	}
+	return make([]bool, len(m.Chunks)), nil
+}
+
+// writeChunk writes chunk i of the transfer described by m into the
+// partial file for name
+func writeChunk(name string, m *Manifest, i int, data []byte) error {
+	part, _ := partNames(name)
+	f, err := os.OpenFile(part, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	off, _ := m.chunk(i)
+	_, err = f.WriteAt(data, off)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// finish checks the partial file for name against m, and if it is
+// intact, renames it into place and removes the saved Manifest. If it
+// is not, the returned error lists the bad chunks.
+func finish(name string, m *Manifest) error {
+	part, mfile := partNames(name)
+	have, ok, err := m.verify(part)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var bad []int
+		for i, h := range have {
+			if !h {
+				bad = append(bad, i)
+			}
+		}
+		return fmt.Errorf("%w: bad chunks %v", errChecksum, bad)
+	}
+	if err = os.Rename(part, name); err != nil {
+		return err
+	}
+	return os.Remove(mfile)
+}
+
+// errChecksum is returned when data does not match its checksum
+var errChecksum = errors.New("checksum mismatch")
+
+// The payloads of the put and get requests are binary, so that
+// chunks are not inflated by encoding. A put is
+//
+//	[8 bytes chunk index][2 bytes path length][path][chunk data]
+//
+// and a get is
+//
+//	[8 bytes offset][4 bytes length][path]
+//
+// with integers in little-endian order.
+
+func putPayload(path string, i int, data []byte) []byte {
+	b := make([]byte, 10, 10+len(path)+len(data))
+	binary.LittleEndian.PutUint64(b, uint64(i))
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(path)))
+	b = append(b, path...)
+	return append(b, data...)
+}
+
+func parsePut(b []byte) (string, int, []byte, error) {
+	if len(b) < 10 {
+		return "", 0, nil, fmt.Errorf("short put request: %d bytes", len(b))
+	}
+	i := binary.LittleEndian.Uint64(b)
+	plen := int(binary.LittleEndian.Uint16(b[8:]))
+	if len(b) < 10+plen {
+		return "", 0, nil, fmt.Errorf("short put request: %d bytes", len(b))
+	}
+	if i > 1<<40 {
+		return "", 0, nil, fmt.Errorf("bad chunk index %d", i)
+	}
+	return string(b[10 : 10+plen]), int(i), b[10+plen:], nil
+}
+
+func getPayload(path string, off, n int64) []byte {
+	b := make([]byte, 12, 12+len(path))
+	binary.LittleEndian.PutUint64(b, uint64(off))
+	binary.LittleEndian.PutUint32(b[8:], uint32(n))
+	return append(b, path...)
+}
+
+func parseGet(b []byte) (string, int64, int64, error) {
+	if len(b) < 12 {
+		return "", 0, 0, fmt.Errorf("short get request: %d bytes", len(b))
+	}
+	off := binary.LittleEndian.Uint64(b)
+	if off > 1<<62 {
+		return "", 0, 0, fmt.Errorf("bad offset %d", off)
+	}
+	return string(b[12:]), int64(off), int64(binary.LittleEndian.Uint32(b[8:])), nil
+}
@@ -0,0 +1,471 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pc "github.com/firepear/petrel/client"
+	ps "github.com/firepear/petrel/server"
+)
+
+var sn = "localhost:60608"
+
+// newServer starts a server with the transfer handlers, serving a new
+// temporary directory, which it returns
+func newServer(t *testing.T, mw ...ps.Middleware) (*ps.Server, string) {
+	root := t.TempDir()
+	s, err := ps.New(&ps.Config{Addr: sn, Xferlim: 64 * 1024})
+	if err != nil {
+		t.Fatalf("%s: couldn't create server: %s", t.Name(), err)
+	}
+	if err = Register(s, &Config{Root: root, MaxChunk: 32 * 1024}, mw...); err != nil {
+		s.Quit()
+		t.Fatalf("%s: couldn't register handlers: %s", t.Name(), err)
+	}
+	return s, root
+}
+
+func newClient(t *testing.T, conf *ClientConfig) (*pc.Client, *Client) {
+	c, err := pc.New(&pc.Config{Addr: sn, Xferlim: 64 * 1024})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	return c, NewClient(c, conf)
+}
+
+// testFile writes a file of n bytes and returns its name and contents
+func testFile(t *testing.T, n int) (string, []byte) {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 31 / 7)
+	}
+	name := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(name, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name, b
+}
+
+// leftovers returns the names of any partial files or manifests in dir
+func leftovers(dir string) []string {
+	m, _ := filepath.Glob(filepath.Join(dir, ".*.petrel-*"))
+	return m
+}
+
+// puts returns how many put requests have succeeded
+func puts(s *ps.Server) uint64 {
+	return s.Metrics().Handlers["transfer.put"].Statuses[200]
+}
+
+func TestTransfer(t *testing.T) {
+	s, root := newServer(t)
+	defer s.Quit()
+	c, tc := newClient(t, &ClientConfig{ChunkSize: 16 * 1024, Parallel: 3})
+	defer c.Quit()
+	ctx := context.Background()
+
+	// up, creating directories on the way
+	src, data := testFile(t, 200*1024+123)
+	if err := tc.Upload(ctx, src, "a/b/file"); err != nil {
+		t.Fatalf("%s: upload failed: %s", t.Name(), err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "a", "b", "file"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s: uploaded file wrong: %d bytes, %v", t.Name(), len(got), err)
+	}
+	if l := leftovers(filepath.Join(root, "a", "b")); len(l) != 0 {
+		t.Errorf("%s: upload left %v", t.Name(), l)
+	}
+	if n := puts(s); n != 13 {
+		t.Errorf("%s: expected 13 puts, got %d", t.Name(), n)
+	}
+
+	// and back down
+	m, err := tc.Stat(ctx, "a/b/file")
+	if err != nil || m.Size != int64(len(data)) || len(m.Chunks) != 13 {
+		t.Errorf("%s: bad stat: %+v %v", t.Name(), m, err)
+	}
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	if err = tc.Download(ctx, "a/b/file", dst); err != nil {
+		t.Fatalf("%s: download failed: %s", t.Name(), err)
+	}
+	got, err = os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s: downloaded file wrong: %d bytes, %v", t.Name(), len(got), err)
+	}
+	if l := leftovers(dir); len(l) != 0 {
+		t.Errorf("%s: download left %v", t.Name(), l)
+	}
+
+	// empty files work too
+	empty, _ := testFile(t, 0)
+	if err = tc.Upload(ctx, empty, "empty"); err != nil {
+		t.Errorf("%s: empty upload failed: %s", t.Name(), err)
+	}
+	if err = tc.Download(ctx, "empty", filepath.Join(dir, "empty")); err != nil {
+		t.Errorf("%s: empty download failed: %s", t.Name(), err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "empty")); err != nil || fi.Size() != 0 {
+		t.Errorf("%s: bad empty download: %v", t.Name(), err)
+	}
+}
+
+func TestTransferConfined(t *testing.T) {
+	s, root := newServer(t)
+	defer s.Quit()
+	c, tc := newClient(t, &ClientConfig{ChunkSize: 16 * 1024})
+	defer c.Quit()
+	ctx := context.Background()
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	src, _ := testFile(t, 10)
+
+	status := func(err error) uint16 {
+		var se *pc.StatusError
+		if errors.As(err, &se) {
+			return se.Status
+		}
+		return 0
+	}
+	for _, path := range []string{"../secret", "/etc/passwd", "link/secret", "link/new", ""} {
+		if _, err := tc.Stat(ctx, path); status(err) != 403 {
+			t.Errorf("%s: stat %q: expected 403, got %v", t.Name(), path, err)
+		}
+		if err := tc.Upload(ctx, src, path); status(err) != 403 {
+			t.Errorf("%s: upload %q: expected 403, got %v", t.Name(), path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); err == nil {
+		t.Errorf("%s: file written outside root", t.Name())
+	}
+
+	// the root itself is not a file, and uploading to it would put
+	// the partial file in the root's parent
+	for _, path := range []string{".", "x/..", "./"} {
+		if err := tc.Upload(ctx, src, path); status(err) != 403 {
+			t.Errorf("%s: upload %q: expected 403, got %v", t.Name(), path, err)
+		}
+	}
+	if l := leftovers(filepath.Dir(root)); len(l) != 0 {
+		t.Errorf("%s: upload to root left %v", t.Name(), l)
+	}
+
+	// nor may a partial file be a symlink leading outside
+	if err := os.Symlink(filepath.Join(outside, "part"),
+		filepath.Join(root, ".f.petrel-part")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Upload(ctx, src, "f"); status(err) != 403 {
+		t.Errorf("%s: upload via part symlink: expected 403, got %v", t.Name(), err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "part")); err == nil {
+		t.Errorf("%s: partial file written outside root", t.Name())
+	}
+	if err := tc.Download(ctx, "nope", filepath.Join(outside, "nope")); status(err) != 404 {
+		t.Errorf("%s: expected 404, got %v", t.Name(), err)
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	// fail the 5th put with an Error level status, which drops the
+	// connection, along with any later puts on that connection.
+	// The puts and gets which succeed are counted here rather than
+	// with Metrics, which are recorded after the response is sent.
+	var (
+		mu      sync.Mutex
+		n       int
+		dropped string
+		ok      = map[string]int{}
+		four    = make(chan struct{})
+	)
+	drop := func(next ps.HandlerCtx) ps.HandlerCtx {
+		return func(ctx context.Context, r *ps.Request) (uint16, []byte, error) {
+			mu.Lock()
+			if r.Name == "transfer.put" {
+				if n++; n == 5 {
+					dropped = r.Id
+				}
+				if r.Id == dropped {
+					mu.Unlock()
+					return 500, nil, errors.New("dropped")
+				}
+			}
+			mu.Unlock()
+			status, pl, err := next(ctx, r)
+			if status == 200 {
+				mu.Lock()
+				if ok[r.Name]++; r.Name == "transfer.put" && ok[r.Name] == 4 {
+					close(four)
+				}
+				mu.Unlock()
+			}
+			return status, pl, err
+		}
+	}
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return ok[name]
+	}
+	s, root := newServer(t, drop)
+	defer s.Quit()
+	ctx := context.Background()
+	src, data := testFile(t, 20*8*1024)
+
+	c, tc := newClient(t, &ClientConfig{ChunkSize: 8 * 1024, Retries: -1})
+	if err := tc.Upload(ctx, src, "file"); err == nil {
+		t.Fatalf("%s: upload should have failed", t.Name())
+	}
+	c.Quit()
+	// the four puts before the drop may still be in flight, but
+	// they are handled all the same, and nothing after it is
+	select {
+	case <-four:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: only %d puts before the drop", t.Name(), count("transfer.put"))
+	}
+	if _, err := os.Stat(filepath.Join(root, "file")); err == nil {
+		t.Fatalf("%s: incomplete file put in place", t.Name())
+	}
+
+	// a new client picks up where the last left off, sending
+	// each chunk exactly once overall
+	c, tc = newClient(t, &ClientConfig{ChunkSize: 8 * 1024})
+	defer c.Quit()
+	if err := tc.Upload(ctx, src, "file"); err != nil {
+		t.Fatalf("%s: resumed upload failed: %s", t.Name(), err)
+	}
+	if total := count("transfer.put"); total != 20 {
+		t.Errorf("%s: expected 20 puts, got %d", t.Name(), total)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "file"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s: resumed file wrong: %d bytes, %v", t.Name(), len(got), err)
+	}
+
+	// a damaged chunk in a partial download is fetched again, and
+	// the intact ones are not
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	m, err := tc.Stat(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = prepare(dst, m); err != nil {
+		t.Fatal(err)
+	}
+	part, _ := partNames(dst)
+	bad := append([]byte{}, data...)
+	bad[3*8*1024] ^= 0xff
+	if err = os.WriteFile(part, bad, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gets := count("transfer.get")
+	if err = tc.Download(ctx, "file", dst); err != nil {
+		t.Fatalf("%s: resumed download failed: %s", t.Name(), err)
+	}
+	if n := count("transfer.get") - gets; n != 1 {
+		t.Errorf("%s: expected 1 get, got %d", t.Name(), n)
+	}
+	got, err = os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s: resumed download wrong: %d bytes, %v", t.Name(), len(got), err)
+	}
+
+	// with a Reconnect policy, a single Upload rides out the drop
+	mu.Lock()
+	n = 0
+	mu.Unlock()
+	rc, err := pc.New(&pc.Config{Addr: sn, Xferlim: 64 * 1024,
+		Reconnect: &pc.RetryPolicy{Attempts: 5, Delay: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("%s: couldn't create client: %s", t.Name(), err)
+	}
+	defer rc.Quit()
+	tc = NewClient(rc, &ClientConfig{ChunkSize: 8 * 1024})
+	if err = tc.Upload(ctx, src, "file2"); err != nil {
+		t.Fatalf("%s: reconnecting upload failed: %s", t.Name(), err)
+	}
+	got, err = os.ReadFile(filepath.Join(root, "file2"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s: reconnected file wrong: %d bytes, %v", t.Name(), len(got), err)
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	root := t.TempDir()
+	s, err := ps.New(&ps.Config{Addr: sn, Xferlim: 64 * 1024})
+	if err != nil {
+		t.Fatalf("%s: couldn't create server: %s", t.Name(), err)
+	}
+	defer s.Quit()
+	err = Register(s, &Config{Root: root, MaxChunk: 32 * 1024, MaxSize: 32 * 1024,
+		MaxUploads: 2, UploadTimeout: 50})
+	if err != nil {
+		t.Fatalf("%s: couldn't register handlers: %s", t.Name(), err)
+	}
+	c, tc := newClient(t, &ClientConfig{ChunkSize: 8 * 1024, Retries: -1})
+	defer c.Quit()
+	ctx := context.Background()
+	src, _ := testFile(t, 20*1024)
+	m, err := fileManifest(src, "", 8*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := func(path string) error {
+		m.Path = path
+		_, err := pc.DispatchTypedCtx[*Manifest, []bool](ctx, c, "transfer.begin", m)
+		return err
+	}
+
+	// a file over MaxSize is refused before any room is set aside
+	// for it
+	big := *m
+	big.Size, big.Chunks = 48*1024, append(m.Chunks, m.Chunks...)
+	big.Path = "big"
+	_, err = pc.DispatchTypedCtx[*Manifest, []bool](ctx, c, "transfer.begin", &big)
+	var se *pc.StatusError
+	if !errors.As(err, &se) || se.Status != 422 || !bytes.Contains(se.Payload, []byte("size 49152")) {
+		t.Errorf("%s: oversized upload should get 422: %v", t.Name(), err)
+	}
+	if l := leftovers(root); len(l) != 0 {
+		t.Errorf("%s: oversized upload left %v", t.Name(), l)
+	}
+
+	// uploads which are begun and never finished count against
+	// the limit
+	for _, path := range []string{"a", "b"} {
+		if err = begin(path); err != nil {
+			t.Fatalf("%s: begin %s failed: %s", t.Name(), path, err)
+		}
+	}
+	var rl *pc.RateLimitError
+	if err = begin("c"); !errors.As(err, &rl) || rl.RetryAfter <= 0 {
+		t.Errorf("%s: third upload should be refused: %v", t.Name(), err)
+	}
+	// puts to uploads which don't exist don't take up room either
+	if err = tc.request(ctx, ".put", putPayload("nope", 0, []byte("x")), nil); err == nil {
+		t.Errorf("%s: put to no upload should fail", t.Name())
+	}
+	if err = begin("c"); !errors.As(err, &rl) {
+		t.Errorf("%s: third upload should still be refused: %v", t.Name(), err)
+	}
+
+	// once they have sat idle long enough, they are cleared away
+	time.Sleep(60 * time.Millisecond)
+	if err = tc.Upload(ctx, src, "c"); err != nil {
+		t.Errorf("%s: upload after idle uploads expired failed: %s", t.Name(), err)
+	}
+	if l := leftovers(root); len(l) != 0 {
+		t.Errorf("%s: expired uploads left %v", t.Name(), l)
+	}
+	if err = tc.request(ctx, ".put", putPayload("a", 0, []byte("x")), nil); err == nil {
+		t.Errorf("%s: put to expired upload should fail", t.Name())
+	}
+}
+
+func TestTransferBackoff(t *testing.T) {
+	// every stat fails with a status which is retried
+	var (
+		mu    sync.Mutex
+		stats []time.Time
+	)
+	fail := func(next ps.HandlerCtx) ps.HandlerCtx {
+		return func(ctx context.Context, r *ps.Request) (uint16, []byte, error) {
+			if r.Name != "transfer.stat" {
+				return next(ctx, r)
+			}
+			mu.Lock()
+			stats = append(stats, time.Now())
+			mu.Unlock()
+			return 520, []byte("busy"), nil
+		}
+	}
+	s, _ := newServer(t, fail)
+	defer s.Quit()
+	ctx := context.Background()
+	dst := filepath.Join(t.TempDir(), "dst")
+
+	// each wait is at least half the nominal delay, which doubles
+	c, tc := newClient(t, &ClientConfig{Retries: 2, RetryDelay: 40 * time.Millisecond})
+	defer c.Quit()
+	var se *pc.StatusError
+	if err := tc.Download(ctx, "file", dst); !errors.As(err, &se) || se.Status != 520 {
+		t.Fatalf("%s: expected status 520, got %v", t.Name(), err)
+	}
+	mu.Lock()
+	if len(stats) != 3 {
+		t.Fatalf("%s: expected 3 tries, got %d", t.Name(), len(stats))
+	}
+	if d := stats[1].Sub(stats[0]); d < 20*time.Millisecond {
+		t.Errorf("%s: first retry after only %s", t.Name(), d)
+	}
+	if d := stats[2].Sub(stats[1]); d < 40*time.Millisecond {
+		t.Errorf("%s: second retry after only %s", t.Name(), d)
+	}
+	stats = nil
+	mu.Unlock()
+
+	// a context which ends during a wait cuts it short
+	tc = NewClient(c, &ClientConfig{Retries: 1, RetryDelay: 10 * time.Second})
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tc.Download(cctx, "file", dst); !errors.As(err, &se) || se.Status != 520 {
+		t.Errorf("%s: expected status 520, got %v", t.Name(), err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("%s: cancelled retry took %s", t.Name(), d)
+	}
+	mu.Lock()
+	if len(stats) != 1 {
+		t.Errorf("%s: expected 1 try, got %d", t.Name(), len(stats))
+	}
+	mu.Unlock()
+}
+
+// an upload which is being written to is not swept away, however
+// long it has been idle
+func TestTransferSweepBusy(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	m := &Manifest{Path: "file", Size: 1, ChunkSize: 1, Chunks: []string{""}}
+	if _, err := prepare(name, m); err != nil {
+		t.Fatal(err)
+	}
+	tf := &files{root: dir, idle: time.Millisecond, ups: map[string]*upload{}}
+	u := &upload{m: m, t: time.Now().Add(-time.Hour)}
+	tf.ups[name] = u
+	if !u.hold() {
+		t.Fatalf("%s: couldn't hold upload", t.Name())
+	}
+	tf.mu.Lock()
+	tf.sweep(time.Now())
+	tf.mu.Unlock()
+	if tf.ups[name] != u || u.gone || len(leftovers(dir)) != 2 {
+		t.Errorf("%s: busy upload was swept: %v", t.Name(), leftovers(dir))
+	}
+	u.release()
+	tf.mu.Lock()
+	tf.sweep(time.Now())
+	tf.mu.Unlock()
+	if tf.ups[name] != nil || !u.gone || len(leftovers(dir)) != 0 {
+		t.Errorf("%s: idle upload was not swept: %v", t.Name(), leftovers(dir))
+	}
+	if u.hold() {
+		t.Errorf("%s: swept upload should not be held", t.Name())
+	}
+}